@@ -84,7 +84,7 @@ var EditConfig = &cobra.Command{
 }
 
 func main() {
-	Root.AddCommand(EditConfig)
+	Root.AddCommand(EditConfig, RotateKey)
 
 	err := Root.Execute()
 	if err != nil {
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/fioncat/wshare/config"
+	"github.com/fioncat/wshare/pkg/osutil"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+var rotateKeyOpts struct {
+	room     string
+	id       int
+	password string
+	promote  bool
+	retire   bool
+}
+
+var RotateKey = &cobra.Command{
+	Use:   "rotate-key",
+	Short: "Rotate the password without downtime",
+	Long: "Rotate the password without downtime. Without flags, add a new pending key, " +
+		"which is accepted but not used to encrypt. When all the machines have the key, " +
+		"promote it with \"--promote\". When all the machines are promoted, drop the old " +
+		"password with \"--retire\". Restart the daemons after each step.",
+
+	RunE: func(_ *cobra.Command, _ []string) error {
+		opts := &rotateKeyOpts
+		if opts.promote && opts.retire {
+			return errors.New("promote and retire cannot be used together")
+		}
+		err := config.Init()
+		if err != nil {
+			return err
+		}
+		doc, err := loadConfigNode()
+		if err != nil {
+			return err
+		}
+		target, err := keysTarget(doc)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case opts.promote:
+			err = promoteKeys(target)
+		case opts.retire:
+			err = retireKeys(target)
+		default:
+			err = addKey(target)
+		}
+		if err != nil {
+			return err
+		}
+		return saveConfigNode(doc)
+	},
+}
+
+func init() {
+	flags := RotateKey.Flags()
+	flags.StringVarP(&rotateKeyOpts.room, "room", "r", "", "rotate the password of the room")
+	flags.IntVar(&rotateKeyOpts.id, "id", -1, "the id of the key to add, generated if not set")
+	flags.StringVar(&rotateKeyOpts.password, "password", "", "the password of the key to add, generated if not set")
+	flags.BoolVar(&rotateKeyOpts.promote, "promote", false, "encrypt with the pending keys")
+	flags.BoolVar(&rotateKeyOpts.retire, "retire", false, "drop the keys older than the one used to encrypt")
+}
+
+// keysNode is the mapping node holding the password and the keys, of the
+// root config or of a room.
+type keysNode struct {
+	node *yaml.Node
+
+	password string
+	keyID    int
+	keys     []*config.Key
+}
+
+func keysTarget(doc *yaml.Node) (*keysNode, error) {
+	root := doc.Content[0]
+	name := rotateKeyOpts.room
+	if name == "" {
+		cfg := config.Get()
+		return &keysNode{
+			node:     root,
+			password: cfg.Password,
+			keyID:    cfg.KeyID,
+			keys:     cfg.Keys,
+		}, nil
+	}
+
+	var room *config.Room
+	for _, r := range config.Get().Rooms {
+		if r.Name == name {
+			room = r
+			break
+		}
+	}
+	rooms := mappingValue(root, "rooms")
+	if room == nil || rooms == nil || rooms.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("cannot find room %q in config", name)
+	}
+	for _, item := range rooms.Content {
+		nameNode := mappingValue(item, "name")
+		if nameNode != nil && nameNode.Value == name {
+			return &keysNode{
+				node:     item,
+				password: room.Password,
+				keyID:    room.KeyID,
+				keys:     room.Keys,
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot find room %q in config", name)
+}
+
+func addKey(target *keysNode) error {
+	id := rotateKeyOpts.id
+	if id < 0 {
+		id = target.keyID
+		for _, key := range target.keys {
+			if key.ID > id {
+				id = key.ID
+			}
+		}
+		id++
+	}
+	if id > 255 {
+		return errors.New("key id is too large, please retire the old keys and use a smaller id")
+	}
+	if id == target.keyID {
+		return fmt.Errorf("key id %d is in use", id)
+	}
+	for _, key := range target.keys {
+		if key.ID == id {
+			return fmt.Errorf("key id %d is in use", id)
+		}
+	}
+
+	password := rotateKeyOpts.password
+	if password == "" {
+		buf := make([]byte, 24)
+		_, err := rand.Read(buf)
+		if err != nil {
+			return fmt.Errorf("failed to generate password: %v", err)
+		}
+		password = base64.RawURLEncoding.EncodeToString(buf)
+	}
+
+	keys := append(target.keys, &config.Key{ID: id, Password: password, Pending: true})
+	err := setMappingValue(target.node, "keys", keys)
+	if err != nil {
+		return err
+	}
+
+	roomFlag := ""
+	if rotateKeyOpts.room != "" {
+		roomFlag = " --room " + rotateKeyOpts.room
+	}
+	fmt.Printf("Added pending key %d\n", id)
+	fmt.Println("Next steps:")
+	fmt.Println("  1. Add the key on the other machines (and the server), then restart them:")
+	fmt.Printf("       wshare-config rotate-key%s --id %d --password %s\n", roomFlag, id, password)
+	fmt.Println("  2. When all the machines have the key, promote it on each one and restart:")
+	fmt.Printf("       wshare-config rotate-key%s --promote\n", roomFlag)
+	fmt.Println("  3. When all the machines are promoted, retire the old password:")
+	fmt.Printf("       wshare-config rotate-key%s --retire\n", roomFlag)
+	return nil
+}
+
+func promoteKeys(target *keysNode) error {
+	var promoted bool
+	for _, key := range target.keys {
+		if key.Pending {
+			key.Pending = false
+			promoted = true
+			fmt.Printf("Promoted key %d\n", key.ID)
+		}
+	}
+	if !promoted {
+		return errors.New("no pending key to promote")
+	}
+	return setMappingValue(target.node, "keys", target.keys)
+}
+
+func retireKeys(target *keysNode) error {
+	// The newest key which is not pending becomes the password, the older
+	// ones are dropped.
+	newest := &config.Key{ID: target.keyID, Password: target.password}
+	for _, key := range target.keys {
+		if !key.Pending && key.ID > newest.ID {
+			newest = key
+		}
+	}
+	if newest.ID == target.keyID {
+		if len(target.keys) == 0 {
+			return errors.New("no key to retire")
+		}
+		return errors.New("no promoted key, please promote the new key first")
+	}
+
+	keys := make([]*config.Key, 0)
+	for _, key := range target.keys {
+		if key.Pending && key.ID > newest.ID {
+			keys = append(keys, key)
+			continue
+		}
+		if key != newest {
+			fmt.Printf("Retired key %d\n", key.ID)
+		}
+	}
+	fmt.Printf("Retired key %d\n", target.keyID)
+
+	err := setMappingValue(target.node, "password", newest.Password)
+	if err != nil {
+		return err
+	}
+	err = setMappingValue(target.node, "key_id", newest.ID)
+	if err != nil {
+		return err
+	}
+	return setMappingValue(target.node, "keys", keys)
+}
+
+func loadConfigNode() (*yaml.Node, error) {
+	data, err := os.ReadFile(config.Path())
+	if os.IsNotExist(err) {
+		data = config.Default
+		err = nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+	var doc yaml.Node
+	err = yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("parse yaml failed: %v", err)
+	}
+	if len(doc.Content) == 0 {
+		// The config file is empty.
+		doc.Kind = yaml.DocumentNode
+		doc.Content = []*yaml.Node{{Kind: yaml.MappingNode}}
+	}
+	if doc.Content[0].Kind != yaml.MappingNode {
+		return nil, errors.New("invalid config file, expect a mapping")
+	}
+	return &doc, nil
+}
+
+func saveConfigNode(doc *yaml.Node) error {
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	err := encoder.Encode(doc)
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %v", err)
+	}
+
+	path := config.Path()
+	err = osutil.EnsureDir(filepath.Dir(path))
+	if err != nil {
+		return fmt.Errorf("failed to ensure dir: %v", err)
+	}
+	// The config holds passwords, keep it private.
+	err = os.WriteFile(path, buf.Bytes(), 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write config: %v", err)
+	}
+	fmt.Printf("Config %s is updated, please restart the daemon\n", path)
+	return nil
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// setMappingValue sets the value of key in the mapping node, the comments
+// of the old value are kept.
+func setMappingValue(node *yaml.Node, key string, value any) error {
+	var valueNode yaml.Node
+	err := valueNode.Encode(value)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %v", key, err)
+	}
+	if old := mappingValue(node, key); old != nil {
+		valueNode.HeadComment = old.HeadComment
+		valueNode.LineComment = old.LineComment
+		valueNode.FootComment = old.FootComment
+		*old = valueNode
+		return nil
+	}
+	node.Content = append(node.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, &valueNode)
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/fioncat/wshare/share"
+	"github.com/spf13/cobra"
+)
+
+func newDevicesCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "devices",
+		Short: "Show the devices connected to the server",
+		Long: "Show the devices connected to the server, and the devices left since the " +
+			"server started. IDLE is the time since the device sent data, LAST SEEN " +
+			"includes the heartbeats.",
+		Args: cobra.NoArgs,
+
+		RunE: func(_ *cobra.Command, _ []string) error {
+			c, err := newSender()
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "ROOM\tNAME\tSTATUS\tLAST SEEN\tIDLE\tVERSION\tHANDLERS")
+			err = c.Presence(func(room *share.Room, roster []*share.Presence) {
+				for _, p := range roster {
+					name := p.Name
+					if p.Self {
+						name += " (this)"
+					}
+					status, seen, idle := "offline", time.Unix(0, p.Since), "-"
+					if p.Online {
+						status, seen = "online", time.Unix(0, p.LastSeen)
+						active := p.LastActive
+						if active == 0 {
+							active = p.Since
+						}
+						idle = time.Since(time.Unix(0, active)).Round(time.Second).String()
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", room.DisplayName(), name, status,
+						humanize.Time(seen), idle, p.Version, strings.Join(p.Handlers, ","))
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return w.Flush()
+		},
+	}
+}
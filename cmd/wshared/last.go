@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+	"github.com/fioncat/wshare/pkg/log"
+	"github.com/fioncat/wshare/share/client"
+	"github.com/spf13/cobra"
+)
+
+func newLastCommand() *cobra.Command {
+	var count int
+
+	cmd := &cobra.Command{
+		Use:   "last",
+		Short: "Show the delivery status of the data sent recently",
+		Long: "Show the delivery status of the data sent recently by the daemon: " +
+			"whether the server received it, and the receipts of the recipients.",
+		Args: cobra.NoArgs,
+
+		RunE: func(_ *cobra.Command, _ []string) error {
+			deliveries, err := client.LoadDeliveries()
+			if err != nil {
+				return err
+			}
+			if len(deliveries) == 0 {
+				fmt.Println("No data sent yet")
+				return nil
+			}
+			if count > 0 && len(deliveries) > count {
+				deliveries = deliveries[:count]
+			}
+			for i, d := range deliveries {
+				if i > 0 {
+					fmt.Println()
+				}
+				showDelivery(d)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().IntVarP(&count, "count", "n", 1, "the number of deliveries to show, 0 to show all")
+	return cmd
+}
+
+func showDelivery(d *client.Delivery) {
+	title := fmt.Sprintf("%s: %s, sent %s", d.Type, log.Size(d.Size), humanize.Time(d.Time))
+	if d.Room != "" {
+		title += fmt.Sprintf(" in room %s", d.Room)
+	}
+	fmt.Println(title)
+
+	if !d.Acked {
+		fmt.Println("  server: not received")
+		return
+	}
+	if len(d.Recipients) == 0 {
+		fmt.Println("  server: received, no recipient")
+		return
+	}
+	fmt.Printf("  server: received, delivered to %s\n", strings.Join(d.Recipients, ", "))
+	for _, name := range d.Recipients {
+		receipt := d.Receipts[name]
+		switch {
+		case receipt == nil:
+			fmt.Printf("  %s: no receipt yet\n", name)
+
+		case receipt.Error != "":
+			fmt.Printf("  %s: failed %s: %s\n", name, humanize.Time(receipt.Time), receipt.Error)
+
+		default:
+			fmt.Printf("  %s: ok %s\n", name, humanize.Time(receipt.Time))
+		}
+	}
+}
@@ -1,15 +1,20 @@
 package main
 
 import (
+	"github.com/fioncat/wshare/config"
 	"github.com/fioncat/wshare/pkg/app"
 	"github.com/fioncat/wshare/pkg/osutil"
 	"github.com/fioncat/wshare/share"
 	"github.com/fioncat/wshare/share/client"
 	"github.com/fioncat/wshare/share/handler/clipboard"
+	"github.com/fioncat/wshare/share/handler/dir"
 )
 
 func startClient() error {
 	share.RegisterHandler("clipboard", clipboard.New)
+	if len(config.Get().Dirs) > 0 {
+		share.RegisterHandler("dir", dir.New)
+	}
 	err := share.InitHandlers()
 	if err != nil {
 		return err
@@ -19,13 +24,15 @@ func startClient() error {
 	if err != nil {
 		return err
 	}
+	handleReconnect(client)
 
-	client.Start()
-	return nil
+	return client.Start()
 }
 
 func main() {
 	cmd := app.CreateManager("wshared", "wshared", startClient)
+	cmd.AddCommand(newSendCommand(), newPairCommand(), newLastCommand(), newReconnectCommand(),
+		newDevicesCommand())
 	err := cmd.Execute()
 	if err != nil {
 		osutil.Exit(err)
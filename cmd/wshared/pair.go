@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dustin/go-humanize"
+	"github.com/fioncat/wshare/share"
+	"github.com/fioncat/wshare/share/device"
+	"github.com/spf13/cobra"
+)
+
+func newPairCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "pair",
+		Short: "Pair this device",
+		Long: "Pair this device, the code shown should be approved on a paired " +
+			"device with \"wshared pair approve <code>\".",
+
+		RunE: func(_ *cobra.Command, _ []string) error {
+			c, err := newSender()
+			if err != nil {
+				return err
+			}
+			fingerprint, err := c.Fingerprint()
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Fingerprint of this device: %s\n", fingerprint)
+			err = c.Pair(func(room *share.Room, code string) {
+				fmt.Printf("Pairing code for room %s: %s\n", room.DisplayName(), code)
+				fmt.Println("Waiting for approving...")
+			})
+			if err != nil {
+				return err
+			}
+			fmt.Println("This device is paired, the devices pinned (please check the fingerprints):")
+			return c.Pins(func(room *share.Room, devices []*device.Device) {
+				for _, d := range devices {
+					fmt.Printf("  %s: %s %s\n", room.DisplayName(), d.Name, d.Fingerprint())
+				}
+			})
+		},
+	}
+
+	var replace bool
+	approveCmd := &cobra.Command{
+		Use:   "approve CODE",
+		Short: "Approve a device to pair",
+		Long: "Approve a device to pair, the fingerprint shown should be the same as the " +
+			"one shown on the device. A paired device with the same name is only " +
+			"replaced with --replace.",
+		Args: cobra.ExactArgs(1),
+
+		RunE: func(_ *cobra.Command, args []string) error {
+			c, err := newSender()
+			if err != nil {
+				return err
+			}
+			d, err := c.Approve(args[0], replace, func(room *share.Room, d, old *device.Device) bool {
+				fmt.Printf("Device %s requests pairing in room %s\n", d.Name, room.DisplayName())
+				fmt.Printf("Fingerprint: %s\n", d.Fingerprint())
+				if old != nil {
+					fmt.Printf("It replaces the paired device with fingerprint: %s\n", old.Fingerprint())
+				}
+				return confirm("Is the fingerprint the same as the one shown on the device?")
+			})
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Device %s is approved, fingerprint: %s\n", d.Name, d.Fingerprint())
+			return nil
+		},
+	}
+	approveCmd.Flags().BoolVar(&replace, "replace", false, "replace the paired device with the same name")
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the paired devices",
+
+		RunE: func(_ *cobra.Command, _ []string) error {
+			c, err := newSender()
+			if err != nil {
+				return err
+			}
+			// The pinned fingerprints by room and name.
+			pins := make(map[string]map[string]string)
+			err = c.Pins(func(room *share.Room, devices []*device.Device) {
+				pins[room.Name] = make(map[string]string, len(devices))
+				for _, d := range devices {
+					pins[room.Name][d.Name] = d.Fingerprint()
+				}
+			})
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "ROOM\tNAME\tFINGERPRINT\tPINNED\tADDED")
+			err = c.Devices(func(room *share.Room, devices []*device.Device) {
+				for _, d := range devices {
+					pinned := "no"
+					if pins[room.Name][d.Name] == d.Fingerprint() {
+						pinned = "yes"
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", room.DisplayName(), d.Name,
+						d.Fingerprint(), pinned, humanize.Time(d.Added))
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return w.Flush()
+		},
+	}
+
+	trustCmd := &cobra.Command{
+		Use:   "trust NAME FINGERPRINT",
+		Short: "Pin a device paired by others",
+		Long: "Pin a device paired by others, so that data is encrypted to it end-to-end. " +
+			"The fingerprint should be checked on the device with \"wshared pair\" or " +
+			"\"wshared pair list\".",
+		Args: cobra.ExactArgs(2),
+
+		RunE: func(_ *cobra.Command, args []string) error {
+			c, err := newSender()
+			if err != nil {
+				return err
+			}
+			err = c.Trust(args[0], args[1])
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Device %s is pinned\n", args[0])
+			return nil
+		},
+	}
+
+	removeCmd := &cobra.Command{
+		Use:   "remove NAME",
+		Short: "Remove a paired device",
+		Args:  cobra.ExactArgs(1),
+
+		RunE: func(_ *cobra.Command, args []string) error {
+			c, err := newSender()
+			if err != nil {
+				return err
+			}
+			err = c.Remove(args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Device %s is removed\n", args[0])
+			return nil
+		},
+	}
+
+	cmd.AddCommand(approveCmd, listCmd, trustCmd, removeCmd)
+	return cmd
+}
+
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
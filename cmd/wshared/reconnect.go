@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/fioncat/wshare/pkg/daemon"
+	"github.com/fioncat/wshare/pkg/log"
+	"github.com/fioncat/wshare/share/client"
+	"github.com/spf13/cobra"
+)
+
+// reconnectSignal tells the daemon to reconnect, see client.Reconnect.
+const reconnectSignal = syscall.SIGUSR1
+
+// handleReconnect reconnects the client when reconnectSignal is received.
+func handleReconnect(c *client.Client) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, reconnectSignal)
+	go func() {
+		for range ch {
+			log.Get().Info("received reconnect signal")
+			c.Reconnect()
+		}
+	}()
+}
+
+func newReconnectCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "reconnect",
+		Short: "Make the daemon reconnect to the server now",
+		Long: "Make the daemon reconnect to the server now, without waiting for the " +
+			"backoff, such as after the network is changed, or the device is approved.",
+		Args: cobra.NoArgs,
+
+		RunE: func(_ *cobra.Command, _ []string) error {
+			d, err := daemon.New("wshared")
+			if err != nil {
+				return err
+			}
+			err = d.Signal(reconnectSignal)
+			if err != nil {
+				return err
+			}
+			fmt.Println("Reconnecting")
+			return nil
+		},
+	}
+}
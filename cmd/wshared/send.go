@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/fioncat/wshare/pkg/app"
+	"github.com/fioncat/wshare/share"
+	"github.com/fioncat/wshare/share/client"
+	"github.com/spf13/cobra"
+)
+
+// newSender creates a client for the commands connecting to the server.
+func newSender() (*client.Client, error) {
+	err := app.CheckPassword()
+	if err != nil {
+		return nil, err
+	}
+	return client.NewSender()
+}
+
+func newSendCommand() *cobra.Command {
+	var (
+		to    []string
+		image bool
+		file  string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "send [text]",
+		Short: "Send text or image to the clipboard of other clients",
+		Long: "Send text or image to the clipboard of other clients. The data is " +
+			"read from the arguments, the file, or stdin.",
+
+		RunE: func(_ *cobra.Command, args []string) error {
+			var data []byte
+			var err error
+			switch {
+			case len(args) > 0:
+				data = []byte(strings.Join(args, " "))
+			case file != "":
+				data, err = os.ReadFile(file)
+			default:
+				data, err = io.ReadAll(os.Stdin)
+			}
+			if err != nil {
+				return err
+			}
+			if len(data) == 0 {
+				return errors.New("no data to send")
+			}
+
+			fmtStr := "text"
+			if image {
+				fmtStr = "image"
+			}
+			c, err := newSender()
+			if err != nil {
+				return err
+			}
+			return c.Send(&share.Packet{
+				Type:     "clipboard",
+				Metadata: []byte(fmtStr),
+				Data:     data,
+				To:       to,
+			})
+		},
+	}
+
+	cmd.Flags().StringSliceVarP(&to, "to", "t", nil, "the clients to send to, default is all")
+	cmd.Flags().BoolVarP(&image, "image", "i", false, "send as image")
+	cmd.Flags().StringVarP(&file, "file", "f", "", "read data from the file")
+	return cmd
+}
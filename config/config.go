@@ -108,16 +108,115 @@ type Config struct {
 	Server string `yaml:"server" validate:"required" json:"server"`
 
 	Password string `yaml:"password" json:"password"`
+	KeyID    int    `yaml:"key_id" validate:"min=0,max=255" json:"key_id"`
+	Keys     []*Key `yaml:"keys" validate:"dive" json:"keys"`
+
+	KDF *KDF `yaml:"kdf" validate:"dive" json:"kdf"`
+
+	Rooms []*Room `yaml:"rooms" validate:"dive" json:"rooms"`
+
+	Pairing bool `yaml:"pairing" json:"pairing"`
+	E2E     bool `yaml:"e2e" json:"e2e"`
 
 	Clipboard *Clipboard `yaml:"clipboard" json:"clipboard"`
 
+	Dirs []*Dir `yaml:"dirs" validate:"dive" json:"dirs"`
+
+	Targets map[string][]string `yaml:"targets" json:"targets"`
+
+	Notify string `yaml:"notify" json:"notify"`
+
+	Offline map[string]string `yaml:"offline" json:"offline"`
+
 	Listen string `yaml:"listen" json:"listen"`
 
+	TLS *TLS `yaml:"tls" json:"tls"`
+
+	Transfer *Transfer `yaml:"transfer" validate:"dive" json:"transfer"`
+
+	Heartbeat *Heartbeat `yaml:"heartbeat" validate:"dive" json:"heartbeat"`
+
+	Queue *Queue `yaml:"queue" validate:"dive" json:"queue"`
+
+	Fanout *Fanout `yaml:"fanout" validate:"dive" json:"fanout"`
+
 	Log *Log `yaml:"log" validate:"dive" json:"log"`
 }
 
+// DefaultPassword is the password in the default config, it must be
+// changed before using.
+const DefaultPassword = "wshare123"
+
+type KDF struct {
+	Cost int `yaml:"cost" validate:"required,min=10,max=20" json:"cost"`
+	R    int `yaml:"r" validate:"required,min=1,max=32" json:"r"`
+	P    int `yaml:"p" validate:"required,min=1,max=4" json:"p"`
+}
+
+type Room struct {
+	Name     string `yaml:"name" validate:"required" json:"name"`
+	Password string `yaml:"password" validate:"required" json:"password"`
+	KeyID    int    `yaml:"key_id" validate:"min=0,max=255" json:"key_id"`
+	Keys     []*Key `yaml:"keys" validate:"dive" json:"keys"`
+}
+
+// Key is an extra password used when rotating the password, see
+// "wshare-config rotate-key".
+type Key struct {
+	ID       int    `yaml:"id" validate:"min=0,max=255" json:"id"`
+	Password string `yaml:"password" validate:"required" json:"password"`
+	Pending  bool   `yaml:"pending,omitempty" json:"pending"`
+}
+
 type Clipboard struct {
 	Readonly bool `yaml:"readonly" json:"readonly"`
+
+	ImageTargets []string `yaml:"image_targets" json:"image_targets"`
+}
+
+type Dir struct {
+	Name string `yaml:"name" validate:"required" json:"name"`
+	Path string `yaml:"path" validate:"required" json:"path"`
+
+	Conflict string `yaml:"conflict" json:"conflict"`
+
+	Ignore []string `yaml:"ignore" json:"ignore"`
+}
+
+type TLS struct {
+	Enable bool `yaml:"enable" json:"enable"`
+
+	Cert string `yaml:"cert" json:"cert"`
+	Key  string `yaml:"key" json:"key"`
+	CA   string `yaml:"ca" json:"ca"`
+
+	Mutual     bool `yaml:"mutual" json:"mutual"`
+	SelfSigned bool `yaml:"self_signed" json:"self_signed"`
+}
+
+type Transfer struct {
+	ChunkSize string `yaml:"chunk_size" validate:"required" json:"chunk_size"`
+	ClockSkew string `yaml:"clock_skew" validate:"required" json:"clock_skew"`
+
+	CompressThreshold string `yaml:"compress_threshold" validate:"required" json:"compress_threshold"`
+
+	MaxSize string `yaml:"max_size" validate:"required" json:"max_size"`
+}
+
+type Heartbeat struct {
+	Interval string `yaml:"interval" validate:"required" json:"interval"`
+	Timeout  string `yaml:"timeout" validate:"required" json:"timeout"`
+}
+
+type Queue struct {
+	MaxSize string `yaml:"max_size" validate:"required" json:"max_size"`
+	TTL     string `yaml:"ttl" validate:"required" json:"ttl"`
+	Persist bool   `yaml:"persist" json:"persist"`
+}
+
+type Fanout struct {
+	Buffer   int    `yaml:"buffer" validate:"required,gt=0" json:"buffer"`
+	Overflow string `yaml:"overflow" validate:"required" json:"overflow"`
 }
 
 type Log struct {
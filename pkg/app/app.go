@@ -13,6 +13,35 @@ import (
 	"github.com/spf13/cobra"
 )
 
+// insecure allows using the default password.
+var insecure bool
+
+// CheckPassword refuses the default password, unless the insecure flag is
+// given.
+func CheckPassword() error {
+	passwords := []string{config.Get().Password}
+	for _, key := range config.Get().Keys {
+		passwords = append(passwords, key.Password)
+	}
+	for _, room := range config.Get().Rooms {
+		passwords = append(passwords, room.Password)
+		for _, key := range room.Keys {
+			passwords = append(passwords, key.Password)
+		}
+	}
+	for _, password := range passwords {
+		if password != config.DefaultPassword {
+			continue
+		}
+		if insecure {
+			log.Get().Warn("the default password is in use, this is insecure")
+			return nil
+		}
+		return errors.New("the default password is in use, please change it in config, or use the \"--insecure\" flag")
+	}
+	return nil
+}
+
 func CreateManager(name, full string, start func() error) *cobra.Command {
 	var d *daemon.Daemon
 
@@ -21,6 +50,10 @@ func CreateManager(name, full string, start func() error) *cobra.Command {
 		Short: fmt.Sprintf("Start %s", name),
 
 		RunE: func(_ *cobra.Command, _ []string) error {
+			err := CheckPassword()
+			if err != nil {
+				return err
+			}
 			return d.Start(start)
 		},
 	}
@@ -48,6 +81,10 @@ func CreateManager(name, full string, start func() error) *cobra.Command {
 		Short: fmt.Sprintf("Restart %s", name),
 
 		RunE: func(cmd *cobra.Command, args []string) error {
+			err := CheckPassword()
+			if err != nil {
+				return err
+			}
 			return d.Restart(start)
 		},
 	}
@@ -87,7 +124,20 @@ func CreateManager(name, full string, start func() error) *cobra.Command {
 			if password == "" {
 				return errors.New("password cannot be empty")
 			}
-			err = crypto.Init(password)
+			kdf := config.Get().KDF
+			saltPath, err := config.LocalFile("kdf.salt")
+			if err != nil {
+				return err
+			}
+			params, err := crypto.LoadParams(saltPath, kdf.Cost, kdf.R, kdf.P)
+			if err != nil {
+				return fmt.Errorf("failed to init key derivation: %v", err)
+			}
+			secrets, err := crypto.Secrets(password, config.Get().KeyID, config.Get().Keys)
+			if err != nil {
+				return err
+			}
+			err = crypto.Init(secrets, params)
 			if err != nil {
 				return fmt.Errorf("failed to init password: %v", err)
 			}
@@ -107,6 +157,8 @@ func CreateManager(name, full string, start func() error) *cobra.Command {
 		},
 	}
 
+	root.PersistentFlags().BoolVar(&insecure, "insecure", false, "allow using the default password")
+
 	root.AddCommand(startCmd, stopCmd, restartCmd, logsCmd, statusCmd)
 	return root
 }
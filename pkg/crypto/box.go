@@ -0,0 +1,278 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/fioncat/wshare/pkg/wire"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Sealed is data encrypted to a set of recipients and signed by the
+// sender.
+//
+// The data is encrypted by a random content key. For each recipient, the
+// content key is encrypted by a key agreed between an ephemeral X25519
+// key and the box key of the recipient.
+type Sealed struct {
+	Sender string
+
+	Ephemeral []byte
+
+	// Keys is the encrypted content key for each recipient.
+	Keys map[string][]byte
+
+	Ciphertext []byte
+
+	// Time (unix nanoseconds) and MessageID are signed with the data, so
+	// that the receivers can reject the replayed packets, even if the
+	// server re-encrypts the frames.
+	Time      int64
+	MessageID string
+
+	Signature []byte
+}
+
+// Seal encrypts data to the recipients (name to box key), and signs it as
+// sender.
+func (id *Identity) Seal(sender string, data []byte, recipients map[string][]byte) (*Sealed, error) {
+	contentKey, err := randomBytes(32)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := sealAES(contentKey, data)
+	if err != nil {
+		return nil, err
+	}
+
+	ephemeralPrivate, err := randomBytes(curve25519.ScalarSize)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := curve25519.X25519(ephemeralPrivate, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string][]byte, len(recipients))
+	for name, boxKey := range recipients {
+		kek, err := wrapKey(ephemeralPrivate, boxKey, ephemeral, boxKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid box key of %s: %v", name, err)
+		}
+		keys[name], err = sealAES(kek, contentKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	messageID, err := randomBytes(16)
+	if err != nil {
+		return nil, err
+	}
+	s := &Sealed{
+		Sender:     sender,
+		Ephemeral:  ephemeral,
+		Keys:       keys,
+		Ciphertext: ciphertext,
+		Time:       time.Now().UnixNano(),
+		MessageID:  hex.EncodeToString(messageID),
+	}
+	s.Signature = id.Sign(s.digest())
+	return s, nil
+}
+
+// Verify reports whether the data is signed by the public key.
+func (s *Sealed) Verify(public []byte) bool {
+	return Verify(public, s.digest(), s.Signature)
+}
+
+// Open decrypts the data as the recipient name. The caller should Verify
+// the sender first.
+func (id *Identity) Open(name string, s *Sealed) ([]byte, error) {
+	wrapped, ok := s.Keys[name]
+	if !ok {
+		return nil, errors.New("not a recipient")
+	}
+	kek, err := wrapKey(id.boxPrivate, s.Ephemeral, s.Ephemeral, id.BoxPublic)
+	if err != nil {
+		return nil, err
+	}
+	contentKey, err := openAES(kek, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt content key: %v", err)
+	}
+	return openAES(contentKey, s.Ciphertext)
+}
+
+func (s *Sealed) digest() []byte {
+	h := sha256.New()
+	write := func(data []byte) {
+		var size [8]byte
+		binary.BigEndian.PutUint64(size[:], uint64(len(data)))
+		h.Write(size[:])
+		h.Write(data)
+	}
+	write([]byte("wshare-sealed"))
+	write([]byte(s.Sender))
+	write(s.Ephemeral)
+	names := make([]string, 0, len(s.Keys))
+	for name := range s.Keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		write([]byte(name))
+		write(s.Keys[name])
+	}
+	write(s.Ciphertext)
+	var sent [8]byte
+	binary.BigEndian.PutUint64(sent[:], uint64(s.Time))
+	write(sent[:])
+	write([]byte(s.MessageID))
+	return h.Sum(nil)
+}
+
+// The field tags of Sealed in the wire format, see docs/protocol.md.
+const (
+	sealedSender     = 1
+	sealedEphemeral  = 2
+	sealedKey        = 3
+	sealedCiphertext = 4
+	sealedSignature  = 5
+	sealedTime       = 6
+	sealedMessageID  = 7
+
+	// The fields of sealedKey.
+	keyName  = 1
+	keyValue = 2
+)
+
+func (s *Sealed) MarshalBinary() ([]byte, error) {
+	var e wire.Encoder
+	e.String(sealedSender, s.Sender)
+	e.Raw(sealedEphemeral, s.Ephemeral)
+	names := make([]string, 0, len(s.Keys))
+	for name := range s.Keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var ke wire.Encoder
+		ke.String(keyName, name)
+		ke.Raw(keyValue, s.Keys[name])
+		e.Raw(sealedKey, ke.Bytes())
+	}
+	e.Raw(sealedCiphertext, s.Ciphertext)
+	e.Raw(sealedSignature, s.Signature)
+	e.Int(sealedTime, s.Time)
+	e.String(sealedMessageID, s.MessageID)
+	return e.Bytes(), nil
+}
+
+func (s *Sealed) UnmarshalBinary(data []byte) error {
+	s.Keys = make(map[string][]byte)
+	return wire.Unmarshal(data, func(tag uint64, value []byte) error {
+		switch tag {
+		case sealedSender:
+			s.Sender = string(value)
+		case sealedEphemeral:
+			s.Ephemeral = value
+		case sealedKey:
+			var name string
+			var key []byte
+			err := wire.Unmarshal(value, func(tag uint64, value []byte) error {
+				switch tag {
+				case keyName:
+					name = string(value)
+				case keyValue:
+					key = value
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			s.Keys[name] = key
+		case sealedCiphertext:
+			s.Ciphertext = value
+		case sealedSignature:
+			s.Signature = value
+		case sealedTime:
+			var err error
+			s.Time, err = wire.Int(value)
+			if err != nil {
+				return err
+			}
+		case sealedMessageID:
+			s.MessageID = string(value)
+		}
+		return nil
+	})
+}
+
+// wrapKey derives the key to encrypt the content key for a recipient.
+func wrapKey(private, public, ephemeral, boxKey []byte) ([]byte, error) {
+	shared, err := curve25519.X25519(private, public)
+	if err != nil {
+		return nil, err
+	}
+	salt := append(append([]byte{}, ephemeral...), boxKey...)
+	key := make([]byte, 32)
+	_, err = io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte("wshare-wrap")), key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func sealAES(key, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := randomBytes(gcm.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, data, nil), nil
+}
+
+func openAES(key, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("no an aes data")
+	}
+	nonce, data := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, data, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func randomBytes(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	_, err := io.ReadFull(rand.Reader, buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate random bytes: %v", err)
+	}
+	return buf, nil
+}
@@ -1,50 +1,393 @@
 package crypto
 
 import (
-	"crypto/aes"
+	"bytes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
+	"os"
+	"sync"
+	"time"
 
+	"github.com/fioncat/wshare/config"
 	"github.com/fioncat/wshare/pkg/log"
+	"golang.org/x/crypto/scrypt"
 )
 
-var (
-	key []byte
+const (
+	// The encrypted data and the authentication handshake carry a
+	// versioned header: magic, version, flags, key id (see Secret), then
+	// the key derivation parameters (see Params). The header is
+	// authenticated with the data. See docs/protocol.md.
+	headerMagic = "wsh"
 
-	block cipher.Block
-	gcm   cipher.AEAD
+	saltSize = 16
+
+	// The limits of the parameters accepted from others, to avoid using
+	// too much memory or cpu.
+	maxLogN   = 20
+	minLogN   = 10
+	maxP      = 4
+	maxMemory = 256 << 20
+
+	// maxPeerKeys limits the keys derived for others' parameters, the
+	// least recently used one is evicted.
+	maxPeerKeys = 1024
+
+	// maxDerivations limits the keys derived at the same time.
+	maxDerivations = 2
 )
 
-func Init(password string) error {
-	sum := sha256.Sum256([]byte(password))
-	key = sum[:32]
+// derivations is the semaphore of the keys being derived.
+var derivations = make(chan struct{}, maxDerivations)
 
-	var err error
-	block, err = aes.NewCipher(key)
+// Version is the protocol version written in the header.
+const Version = 4
+
+// ErrLegacy is returned when decrypting data from old versions.
+var ErrLegacy = errors.New("data is encrypted by an old version of wshare, please upgrade it")
+
+// Secret is a password with its key id. Several secrets can be active when
+// rotating the password, the id in the header tells the receivers which
+// one to derive the key from.
+type Secret struct {
+	ID       uint8
+	Password string
+}
+
+// Secrets returns the password and the keys (see config.Key) as secrets,
+// the one to encrypt with comes first: the newest which is not pending.
+func Secrets(password string, keyID int, keys []*config.Key) ([]Secret, error) {
+	secrets := []Secret{{ID: uint8(keyID), Password: password}}
+	ids := map[int]struct{}{keyID: {}}
+	for _, key := range keys {
+		if _, ok := ids[key.ID]; ok {
+			return nil, fmt.Errorf("duplicate key id %d", key.ID)
+		}
+		ids[key.ID] = struct{}{}
+		secret := Secret{ID: uint8(key.ID), Password: key.Password}
+		if !key.Pending && key.ID > int(secrets[0].ID) {
+			secrets = append([]Secret{secret}, secrets...)
+			continue
+		}
+		secrets = append(secrets, secret)
+	}
+	return secrets, nil
+}
+
+// Params is the parameters to derive the key from the password with
+// scrypt. Each client has its own salt, so the receivers derive the key
+// with the parameters in the header of the data.
+type Params struct {
+	// LogN is log2 of the cost N, R and P are the block size and the
+	// parallelization.
+	LogN uint8
+	R    uint8
+	P    uint8
+
+	Salt []byte
+}
+
+// DefaultParams returns the default parameters with a random salt.
+func DefaultParams() (*Params, error) {
+	salt, err := randomBytes(saltSize)
+	if err != nil {
+		return nil, err
+	}
+	return &Params{LogN: 15, R: 8, P: 1, Salt: salt}, nil
+}
+
+// LoadParams returns the parameters with the salt saved in path, a new
+// salt is generated and saved if the file does not exist.
+func LoadParams(path string, logN, r, p int) (*Params, error) {
+	salt, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		salt, err = randomBytes(saltSize)
+		if err != nil {
+			return nil, err
+		}
+		err = os.WriteFile(path, salt, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to save salt: %v", err)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read salt: %v", err)
+	}
+	if len(salt) != saltSize {
+		return nil, fmt.Errorf("invalid salt file %s", path)
+	}
+	params := &Params{
+		LogN: uint8(logN),
+		R:    uint8(r),
+		P:    uint8(p),
+		Salt: salt,
+	}
+	if logN != int(params.LogN) || r != int(params.R) || p != int(params.P) {
+		return nil, errors.New("invalid key derivation parameters")
+	}
+	return params, params.check()
+}
+
+func (p *Params) equal(o *Params) bool {
+	return p.LogN == o.LogN && p.R == o.R && p.P == o.P && bytes.Equal(p.Salt, o.Salt)
+}
+
+func (p *Params) check() error {
+	if p.LogN < minLogN || p.LogN > maxLogN {
+		return fmt.Errorf("key derivation cost must be in [%d, %d]", minLogN, maxLogN)
+	}
+	if p.R == 0 || p.P == 0 {
+		return errors.New("key derivation r and p must be positive")
+	}
+	if p.P > maxP {
+		return fmt.Errorf("key derivation p must be at most %d", maxP)
+	}
+	if 128*int64(p.R)<<p.LogN > maxMemory {
+		return errors.New("key derivation uses too much memory")
+	}
+	if len(p.Salt) != saltSize {
+		return errors.New("invalid salt size")
+	}
+	return nil
+}
+
+// within reports whether deriving with p costs no more cpu and memory than
+// with o.
+func (p *Params) within(o *Params) bool {
+	return int64(p.R)*int64(p.P)<<p.LogN <= int64(o.R)*int64(o.P)<<o.LogN &&
+		int64(p.R)<<p.LogN <= int64(o.R)<<o.LogN
+}
+
+func (p *Params) header(flags, id uint8) []byte {
+	header := make([]byte, 0, len(headerMagic)+7+len(p.Salt))
+	header = append(header, headerMagic...)
+	header = append(header, Version, flags, id, p.LogN, p.R, p.P, byte(len(p.Salt)))
+	return append(header, p.Salt...)
+}
+
+// header is the parsed header.
+type header struct {
+	params *Params
+	flags  uint8
+	id     uint8
+	size   int
+}
+
+// parseHeader parses the header at the beginning of data.
+func parseHeader(data []byte) (*header, error) {
+	if !bytes.HasPrefix(data, []byte(headerMagic)) {
+		return nil, ErrLegacy
+	}
+	data = data[len(headerMagic):]
+	if len(data) < 1 {
+		return nil, errors.New("invalid crypto header")
+	}
+	if data[0] < Version {
+		return nil, ErrLegacy
+	}
+	if data[0] > Version {
+		return nil, fmt.Errorf("unsupported protocol version %d, please upgrade wshare", data[0])
+	}
+	if len(data) < 7 {
+		return nil, errors.New("invalid crypto header")
+	}
+	saltLen := int(data[6])
+	if len(data) < 7+saltLen {
+		return nil, errors.New("invalid crypto header")
+	}
+	p := &Params{
+		LogN: data[3],
+		R:    data[4],
+		P:    data[5],
+		Salt: data[7 : 7+saltLen],
+	}
+	err := p.check()
+	if err != nil {
+		return nil, fmt.Errorf("invalid crypto header: %v", err)
+	}
+	return &header{
+		params: p,
+		flags:  data[1],
+		id:     data[2],
+		size:   len(headerMagic) + 7 + saltLen,
+	}, nil
+}
+
+type derived struct {
+	// authKey is derived from key, it is used for the authentication
+	// handshake, so that the encryption key is not used for two purposes.
+	authKey []byte
+
+	gcm cipher.AEAD
+}
+
+func derive(password []byte, p *Params) (*derived, error) {
+	derivations <- struct{}{}
+	defer func() { <-derivations }()
+	key, err := scrypt.Key(password, p.Salt, 1<<p.LogN, int(p.R), int(p.P), 32)
 	if err != nil {
-		return fmt.Errorf("failed to validate aes key: %v", err)
+		return nil, fmt.Errorf("failed to derive key: %v", err)
 	}
 
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("wshare-auth"))
+
 	// gcm or Galois/Counter Mode, is a mode of operation
 	// for symmetric key cryptographic block ciphers
 	// - https://en.wikipedia.org/wiki/Galois/Counter_Mode
-	gcm, err = cipher.NewGCM(block)
+	gcm, err := newGCM(key)
 	if err != nil {
-		return fmt.Errorf("failed to init gcm: %v", err)
+		return nil, fmt.Errorf("failed to init gcm: %v", err)
 	}
+	return &derived{authKey: mac.Sum(nil), gcm: gcm}, nil
+}
 
-	return nil
+// Key encrypts data and authenticates clients with a key derived from a
+// password. When rotating the password, the key decrypts data with any of
+// the secrets, and encrypts with the first one.
+type Key struct {
+	secrets map[uint8][]byte
+
+	params *Params
+	id     uint8
+	own    *derived
+
+	// peers is the keys derived with others' parameters, by key id and
+	// parameters.
+	mu    sync.Mutex
+	peers map[string]*peerKey
 }
 
-func Encrypt(data []byte) []byte {
-	if len(key) == 0 {
-		return data
+type peerKey struct {
+	*derived
+	used time.Time
+}
+
+// NewKey derives the key from password, with key id 0. A random salt is
+// used if params is nil.
+func NewKey(password string, params *Params) (*Key, error) {
+	return NewKeySet([]Secret{{Password: password}}, params)
+}
+
+// NewKeySet is like NewKey, but accepts several secrets, the first one is
+// used to encrypt.
+func NewKeySet(secrets []Secret, params *Params) (*Key, error) {
+	if len(secrets) == 0 {
+		return nil, errors.New("no secret")
+	}
+	passwords := make(map[uint8][]byte, len(secrets))
+	for _, secret := range secrets {
+		if _, ok := passwords[secret.ID]; ok {
+			return nil, fmt.Errorf("duplicate key id %d", secret.ID)
+		}
+		passwords[secret.ID] = []byte(secret.Password)
 	}
 
+	var err error
+	if params == nil {
+		params, err = DefaultParams()
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = params.check()
+	if err != nil {
+		return nil, err
+	}
+	own, err := derive(passwords[secrets[0].ID], params)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{
+		secrets: passwords,
+		params:  params,
+		id:      secrets[0].ID,
+		own:     own,
+		peers:   make(map[string]*peerKey),
+	}, nil
+}
+
+// Params returns the parameters of the key.
+func (k *Key) Params() *Params {
+	return k.params
+}
+
+// Header returns the versioned header, the peer uses it to derive the same
+// key, see AuthMAC.
+func (k *Key) Header() []byte {
+	return k.params.header(0, k.id)
+}
+
+// peer returns the key derived with the parameters and the key id in h.
+// If limit is true, the parameters must not cost more than ours, so that
+// others cannot make us use too much cpu or memory.
+func (k *Key) peer(h *header, limit bool) (*derived, error) {
+	if h.id == k.id && h.params.equal(k.params) {
+		return k.own, nil
+	}
+	// The flags are not part of the key.
+	cacheKey := string(h.params.header(0, h.id))
+	k.mu.Lock()
+	pk := k.peers[cacheKey]
+	if pk != nil {
+		pk.used = time.Now()
+	}
+	k.mu.Unlock()
+	if pk != nil {
+		return pk.derived, nil
+	}
+
+	if limit && !h.params.within(k.params) {
+		return nil, errors.New("key derivation parameters cost more than ours")
+	}
+	password, ok := k.secrets[h.id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %d, the key is not added or is retired", h.id)
+	}
+	d, err := derive(password, h.params)
+	if err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if len(k.peers) >= maxPeerKeys {
+		var oldest string
+		for key, pk := range k.peers {
+			if oldest == "" || pk.used.Before(k.peers[oldest].used) {
+				oldest = key
+			}
+		}
+		delete(k.peers, oldest)
+	}
+	k.peers[cacheKey] = &peerKey{derived: d, used: time.Now()}
+	return d, nil
+}
+
+// KeyHeader returns the header of the key that data is encrypted with,
+// without the flags. It tells the keys used by a sender without deriving
+// them.
+func KeyHeader(data []byte) (string, error) {
+	h, err := parseHeader(data)
+	if err != nil {
+		return "", err
+	}
+	return string(h.params.header(0, h.id)), nil
+}
+
+func (k *Key) Encrypt(data []byte) []byte {
+	return k.EncryptFlags(data, 0)
+}
+
+// EncryptFlags encrypts data with the flags in the header, the flags are
+// authenticated but not encrypted.
+func (k *Key) EncryptFlags(data []byte, flags uint8) []byte {
+	gcm := k.own.gcm
+	header := k.params.header(flags, k.id)
 	// creates a new byte array the size of the nonce
 	// which must be passed to Seal
 	nonce := make([]byte, gcm.NonceSize())
@@ -57,24 +400,117 @@ func Encrypt(data []byte) []byte {
 		log.Get().Warnf("internal: failed to generate random sequence: %v", err)
 	}
 
-	return gcm.Seal(nonce, nonce, data, nil)
+	dst := make([]byte, 0, len(header)+len(nonce)+len(data)+gcm.Overhead())
+	dst = append(dst, header...)
+	dst = append(dst, nonce...)
+	return gcm.Seal(dst, nonce, data, header)
 }
 
-func Decrypt(data []byte) ([]byte, error) {
-	if len(key) == 0 {
-		return data, nil
+func (k *Key) Decrypt(data []byte) ([]byte, error) {
+	src, _, err := k.DecryptFlags(data)
+	return src, err
+}
+
+// DecryptFlags decrypts data, returns the flags in the header.
+func (k *Key) DecryptFlags(data []byte) ([]byte, uint8, error) {
+	h, err := parseHeader(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	d, err := k.peer(h, true)
+	if err != nil {
+		return nil, 0, err
 	}
+	header, data := data[:h.size], data[h.size:]
 
-	nonceSize := gcm.NonceSize()
+	nonceSize := d.gcm.NonceSize()
 	if len(data) < nonceSize {
-		return nil, errors.New("no an aes data")
+		return nil, 0, errors.New("no an aes data")
 	}
 
 	var nonce []byte
 	nonce, data = data[:nonceSize], data[nonceSize:]
-	src, err := gcm.Open(nil, nonce, data, nil)
+	src, err := d.gcm.Open(nil, nonce, data, header)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+	return src, h.flags, nil
+}
+
+// AuthMAC returns the MAC of data for the authentication handshake, under
+// the key derived with the parameters published by the server (see
+// Header), and the header to send with it. The own key id is used, so
+// that the server can choose the password.
+func (k *Key) AuthMAC(server, data []byte) ([]byte, []byte, error) {
+	h, err := parseHeader(server)
+	if err != nil {
+		return nil, nil, err
+	}
+	if h.size != len(server) {
+		return nil, nil, errors.New("invalid crypto header")
+	}
+	h.id = k.id
+	d, err := k.peer(h, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	return h.params.header(0, k.id), computeMAC(d.authKey, data), nil
+}
+
+// CheckMAC reports whether sum is the MAC of data, see AuthMAC. The header
+// must have the parameters of k, so that clients cannot make us derive
+// keys with parameters they choose before they are authenticated.
+func (k *Key) CheckMAC(header, data, sum []byte) (bool, error) {
+	h, err := parseHeader(header)
+	if err != nil {
+		return false, err
+	}
+	if h.size != len(header) {
+		return false, errors.New("invalid crypto header")
+	}
+	if !h.params.equal(k.params) {
+		return false, errors.New("key derivation parameters do not match the server")
+	}
+	d, err := k.peer(h, false)
+	if err != nil {
+		return false, err
+	}
+	return hmac.Equal(computeMAC(d.authKey, data), sum), nil
+}
+
+func computeMAC(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// defaultKey is derived from the global password.
+var defaultKey *Key
+
+func Init(secrets []Secret, params *Params) error {
+	var err error
+	defaultKey, err = NewKeySet(secrets, params)
+	return err
+}
+
+// Default returns the key initialized by Init.
+func Default() *Key {
+	if defaultKey == nil {
+		panic("internal: please call crypto.Init before using Default()")
+	}
+	return defaultKey
+}
+
+func Encrypt(data []byte) []byte {
+	if defaultKey == nil {
+		return data
+	}
+	return defaultKey.Encrypt(data)
+}
+
+func Decrypt(data []byte) ([]byte, error) {
+	if defaultKey == nil {
+		return data, nil
 	}
-	return src, nil
+	return defaultKey.Decrypt(data)
 }
@@ -1,13 +1,14 @@
 package crypto
 
 import (
+	"path/filepath"
 	"reflect"
 	"testing"
 )
 
 func TestEncrypt(t *testing.T) {
 	password := "test12345"
-	err := Init(password)
+	err := Init([]Secret{{Password: password}}, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -23,7 +24,7 @@ func TestEncrypt(t *testing.T) {
 		t.Fatal("unexpect decrypt result")
 	}
 
-	err = Init("wrong password!")
+	err = Init([]Secret{{Password: "wrong password!"}}, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -36,3 +37,208 @@ func TestEncrypt(t *testing.T) {
 		t.Fatal("expect message not equal")
 	}
 }
+
+func TestKey(t *testing.T) {
+	a, err := NewKey("test12345", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, err := LoadParams(filepath.Join(t.TempDir(), "salt"), 12, 8, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewKey("test12345", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("This is a secrect message!!!!!!")
+	raw, err := a.Decrypt(b.Encrypt(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(raw, data) {
+		t.Fatal("unexpect decrypt result")
+	}
+	// b does not derive keys costing more than its own.
+	_, err = b.Decrypt(a.Encrypt(data))
+	if err == nil {
+		t.Fatal("expect error for parameters costing more")
+	}
+
+	header, sum, err := a.AuthMAC(b.Header(), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := b.CheckMAC(header, data, sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("expect mac to be valid")
+	}
+	ok, err = b.CheckMAC(header, []byte("other"), sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("expect mac of other data to be invalid")
+	}
+	_, err = b.CheckMAC(a.Header(), data, sum)
+	if err == nil {
+		t.Fatal("expect error for other parameters")
+	}
+
+	result := b.EncryptFlags(data, 1)
+	raw, flags, err := a.DecryptFlags(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags != 1 || !reflect.DeepEqual(raw, data) {
+		t.Fatal("unexpect decrypt result with flags")
+	}
+	// The flags are authenticated.
+	result[len(headerMagic)+1] = 0
+	_, err = a.Decrypt(result)
+	if err == nil {
+		t.Fatal("expect error for modified flags")
+	}
+
+	_, err = b.Decrypt([]byte("legacy data without header"))
+	if err != ErrLegacy {
+		t.Fatalf("expect legacy error, found %v", err)
+	}
+
+	_, err = LoadParams(filepath.Join(t.TempDir(), "salt"), 30, 8, 1)
+	if err == nil {
+		t.Fatal("expect error for too big cost")
+	}
+}
+
+func TestKeySet(t *testing.T) {
+	oldKey, err := NewKey("old-password", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The new key is pending, accepted but not used to encrypt.
+	pending, err := NewKeySet([]Secret{{0, "old-password"}, {1, "new-password"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	promoted, err := NewKeySet([]Secret{{1, "new-password"}, {0, "old-password"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("This is a secrect message!!!!!!")
+	for _, key := range []*Key{oldKey, pending, promoted} {
+		raw, err := pending.Decrypt(key.Encrypt(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(raw, data) {
+			t.Fatal("unexpect decrypt result")
+		}
+	}
+	_, err = oldKey.Decrypt(promoted.Encrypt(data))
+	if err == nil {
+		t.Fatal("expect error for unknown key id")
+	}
+
+	_, err = NewKeySet([]Secret{{1, "a"}, {1, "b"}}, nil)
+	if err == nil {
+		t.Fatal("expect error for duplicate key id")
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "device.key")
+	id, err := LoadIdentity(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("wshare-sign")
+	sig := id.Sign(data)
+	if !Verify(id.Public, data, sig) {
+		t.Fatal("expect signature to be valid")
+	}
+	if Verify(id.Public, []byte("other"), sig) {
+		t.Fatal("expect signature to be invalid")
+	}
+
+	loaded, err := LoadIdentity(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.Public, id.Public) {
+		t.Fatal("expect same key after reloading")
+	}
+	if Fingerprint(loaded.Public) != Fingerprint(id.Public) {
+		t.Fatal("expect same fingerprint")
+	}
+}
+
+func TestSeal(t *testing.T) {
+	dir := t.TempDir()
+	sender, err := LoadIdentity(filepath.Join(dir, "sender.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient, err := LoadIdentity(filepath.Join(dir, "recipient.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := LoadIdentity(filepath.Join(dir, "other.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !VerifyBoxKey(recipient.Public, recipient.BoxPublic, recipient.BoxSignature()) {
+		t.Fatal("expect box key signature to be valid")
+	}
+
+	data := []byte("This is a secrect message!!!!!!")
+	sealed, err := sender.Seal("sender", data, map[string][]byte{
+		"recipient": recipient.BoxPublic,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := sealed.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed = new(Sealed)
+	err = sealed.UnmarshalBinary(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sealed.Verify(sender.Public) {
+		t.Fatal("expect signature to be valid")
+	}
+	if sealed.Verify(other.Public) {
+		t.Fatal("expect signature of other to be invalid")
+	}
+
+	raw, err := recipient.Open("recipient", sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(raw, data) {
+		t.Fatal("unexpect open result")
+	}
+
+	_, err = other.Open("recipient", sealed)
+	if err == nil {
+		t.Fatal("expect error for other identity")
+	}
+	_, err = other.Open("other", sealed)
+	if err == nil {
+		t.Fatal("expect error for non-recipient")
+	}
+
+	sealed.Sender = "other"
+	if sealed.Verify(sender.Public) {
+		t.Fatal("expect signature to be invalid after tampering")
+	}
+}
@@ -0,0 +1,108 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// Identity is the key pair of a device, it is used to authenticate the
+// device, so that devices can be trusted or removed one by one.
+//
+// The identity also has an X25519 key pair (the box key) derived from the
+// same seed, to encrypt data to the device, see Seal.
+type Identity struct {
+	Public ed25519.PublicKey
+
+	private ed25519.PrivateKey
+
+	BoxPublic []byte
+
+	boxPrivate []byte
+}
+
+// LoadIdentity reads the identity from path, a new one is generated and
+// saved if the file does not exist.
+func LoadIdentity(path string) (*Identity, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate key pair: %v", err)
+		}
+		seed := hex.EncodeToString(private.Seed())
+		err = os.WriteFile(path, []byte(seed+"\n"), 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to save identity: %v", err)
+		}
+		return newIdentity(private)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity: %v", err)
+	}
+
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid identity file %s", path)
+	}
+	return newIdentity(ed25519.NewKeyFromSeed(seed))
+}
+
+func newIdentity(private ed25519.PrivateKey) (*Identity, error) {
+	boxPrivate := sha256.Sum256(append([]byte("wshare-box\n"), private.Seed()...))
+	boxPublic, err := curve25519.X25519(boxPrivate[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive box key: %v", err)
+	}
+	return &Identity{
+		Public:     private.Public().(ed25519.PublicKey),
+		private:    private,
+		BoxPublic:  boxPublic,
+		boxPrivate: boxPrivate[:],
+	}, nil
+}
+
+func (id *Identity) Sign(data []byte) []byte {
+	return ed25519.Sign(id.private, data)
+}
+
+// BoxSignature returns the signature of the box key, so that others can
+// check the box key belongs to the identity, see VerifyBoxKey.
+func (id *Identity) BoxSignature() []byte {
+	return id.Sign(boxMessage(id.BoxPublic))
+}
+
+// VerifyBoxKey reports whether sig is the signature of the box key by the
+// public key.
+func VerifyBoxKey(public, boxKey, sig []byte) bool {
+	return Verify(public, boxMessage(boxKey), sig)
+}
+
+func boxMessage(boxKey []byte) []byte {
+	return append([]byte("wshare-box-key\n"), boxKey...)
+}
+
+// Verify reports whether sig is the signature of data by the public key.
+func Verify(public, data, sig []byte) bool {
+	if len(public) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(public, data, sig)
+}
+
+// Fingerprint returns a short text to compare public keys by eye.
+func Fingerprint(public []byte) string {
+	sum := sha256.Sum256(public)
+	text := hex.EncodeToString(sum[:8])
+	parts := make([]string, 0, 4)
+	for i := 0; i < len(text); i += 4 {
+		parts = append(parts, text[i:i+4])
+	}
+	return strings.Join(parts, "-")
+}
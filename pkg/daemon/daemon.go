@@ -101,6 +101,18 @@ func (d *Daemon) GetProcess() (*os.Process, error) {
 	return os.FindProcess(d.pid)
 }
 
+// Signal sends sig to the running daemon.
+func (d *Daemon) Signal(sig os.Signal) error {
+	process, err := d.GetProcess()
+	if err != nil {
+		return fmt.Errorf("failed to get process: %v", err)
+	}
+	if process == nil || !isRunning(process) {
+		return fmt.Errorf("%s is not running", d.name)
+	}
+	return process.Signal(sig)
+}
+
 func (d *Daemon) Stop() error {
 	process, err := d.GetProcess()
 	if err != nil {
@@ -0,0 +1,176 @@
+package ignore
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// FileName is the name of the ignore file in the root of a directory.
+const FileName = ".wshareignore"
+
+type rule struct {
+	re *regexp.Regexp
+
+	negate  bool
+	dirOnly bool
+}
+
+// Matcher matches paths against gitignore-style patterns:
+//   - Blank lines and lines starting with "#" are skipped.
+//   - A pattern starting with "!" re-includes paths excluded before.
+//   - A pattern ending with "/" only matches directories.
+//   - A pattern containing "/" (except at the end) is relative to the
+//     root, otherwise it matches at any depth.
+//   - "*", "?" and "[...]" match within a path segment, "**" matches any
+//     number of segments.
+//
+// Like git, the last matching pattern wins, and a path is ignored if any
+// of its parent directories is ignored.
+type Matcher struct {
+	rules []*rule
+}
+
+func New(patterns []string) (*Matcher, error) {
+	m := &Matcher{}
+	for _, pattern := range patterns {
+		r, err := parse(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ignore pattern %q: %v", pattern, err)
+		}
+		if r != nil {
+			m.rules = append(m.rules, r)
+		}
+	}
+	return m, nil
+}
+
+// Load creates a matcher with the patterns, plus the patterns in the
+// ignore file under root, if it exists.
+func Load(root string, patterns []string) (*Matcher, error) {
+	data, err := os.ReadFile(filepath.Join(root, FileName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read %s: %v", FileName, err)
+	}
+	all := make([]string, len(patterns))
+	copy(all, patterns)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		all = append(all, scanner.Text())
+	}
+	return New(all)
+}
+
+func parse(pattern string) (*rule, error) {
+	pattern = strings.TrimRight(pattern, " \t\r")
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return nil, nil
+	}
+
+	r := &rule{}
+	if strings.HasPrefix(pattern, "!") {
+		r.negate = true
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		r.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+	if pattern == "" {
+		return nil, nil
+	}
+
+	var expr strings.Builder
+	expr.WriteString("^")
+	if !anchored {
+		expr.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(pattern); i++ {
+		ch := pattern[i]
+		switch ch {
+		case '*':
+			if strings.HasPrefix(pattern[i:], "**") {
+				rest := pattern[i+2:]
+				switch {
+				case strings.HasPrefix(rest, "/"):
+					// "**/" matches zero or more directories.
+					expr.WriteString("(?:.*/)?")
+					i += 2
+				default:
+					expr.WriteString(".*")
+					i++
+				}
+				continue
+			}
+			expr.WriteString("[^/]*")
+
+		case '?':
+			expr.WriteString("[^/]")
+
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				expr.WriteString(regexp.QuoteMeta("["))
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + class + "]")
+			i += end + 1
+
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				ch = pattern[i]
+			}
+			expr.WriteString(regexp.QuoteMeta(string(ch)))
+
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	expr.WriteString("$")
+
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, err
+	}
+	r.re = re
+	return r, nil
+}
+
+// Match reports whether a slash separated path relative to the root is
+// ignored. dir tells whether the path is a directory.
+func (m *Matcher) Match(path string, dir bool) bool {
+	if m == nil || len(m.rules) == 0 {
+		return false
+	}
+	parts := strings.Split(path, "/")
+	for i := 1; i < len(parts); i++ {
+		if m.match(strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+	return m.match(path, dir)
+}
+
+func (m *Matcher) match(path string, dir bool) bool {
+	ignored := false
+	for _, r := range m.rules {
+		if r.dirOnly && !dir {
+			continue
+		}
+		if r.re.MatchString(path) {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
@@ -0,0 +1,50 @@
+package ignore
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	m, err := New([]string{
+		"# comment",
+		".git/",
+		"node_modules",
+		"*.log",
+		"!keep.log",
+		"/build",
+		"docs/**/*.tmp",
+		"a?c.txt",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		path   string
+		dir    bool
+		expect bool
+	}{
+		{".git", true, true},
+		{".git/config", false, true},
+		{"sub/.git", true, true},
+		{".git", false, false},
+		{"node_modules/x/index.js", false, true},
+		{"web/node_modules", true, true},
+		{"out.log", false, true},
+		{"sub/out.log", false, true},
+		{"keep.log", false, false},
+		{"build", true, true},
+		{"build/main.o", false, true},
+		{"sub/build", true, false},
+		{"docs/a.tmp", false, true},
+		{"docs/x/y/a.tmp", false, true},
+		{"a.tmp", false, false},
+		{"abc.txt", false, true},
+		{"abbc.txt", false, false},
+		{"main.go", false, false},
+	}
+	for _, c := range cases {
+		result := m.Match(c.path, c.dir)
+		if result != c.expect {
+			t.Fatalf("match %q: expect %v, found %v", c.path, c.expect, result)
+		}
+	}
+}
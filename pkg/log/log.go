@@ -58,6 +58,10 @@ func Get() *logrus.Logger {
 }
 
 func BytesSize(data []byte) string {
-	size := humanize.IBytes(uint64(len(data)))
+	return Size(int64(len(data)))
+}
+
+func Size(n int64) string {
+	size := humanize.IBytes(uint64(n))
 	return strings.Replace(size, " ", "", 1)
 }
@@ -0,0 +1,237 @@
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/fioncat/wshare/pkg/osutil"
+)
+
+// Entry describes a regular file in a directory tree.
+type Entry struct {
+	Path    string      `json:"path"`
+	Size    int64       `json:"size"`
+	Mode    fs.FileMode `json:"mode"`
+	ModTime int64       `json:"mtime"`
+	Hash    string      `json:"hash"`
+
+	Version Version `json:"version,omitempty"`
+}
+
+// Manifest is a snapshot of a directory tree, the files are indexed by
+// slash separated paths relative to the root.
+type Manifest struct {
+	Files map[string]*Entry `json:"files"`
+}
+
+func New() *Manifest {
+	return &Manifest{Files: make(map[string]*Entry)}
+}
+
+// Filter reports whether a path (relative to the root) should be left
+// out of the manifest. For directories, the whole tree is skipped.
+type Filter func(path string, dir bool) bool
+
+// Build walks the root and creates a new manifest. If a file has the same
+// size and mtime in prev, its hash is reused instead of reading the file
+// again. The version of a file is always copied from prev. prev and
+// filter can be nil.
+func Build(root string, prev *Manifest, filter Filter) (*Manifest, error) {
+	m := New()
+	err := filepath.Walk(root, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// The file was removed during walking.
+				return nil
+			}
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if filter != nil && filter(rel, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		e := &Entry{
+			Path:    rel,
+			Size:    info.Size(),
+			Mode:    info.Mode().Perm(),
+			ModTime: info.ModTime().UnixNano(),
+		}
+		if prev != nil {
+			old := prev.Files[rel]
+			if old != nil {
+				e.Version = old.Version
+				if old.Size == e.Size && old.ModTime == e.ModTime {
+					e.Hash = old.Hash
+				}
+			}
+		}
+		if e.Hash == "" {
+			e.Hash, err = osutil.SumFile(path)
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return fmt.Errorf("failed to sum %s: %v", rel, err)
+			}
+		}
+		m.Files[rel] = e
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Stat creates an entry for a single file under the root.
+func Stat(root, name string) (*Entry, error) {
+	path := filepath.Join(root, filepath.FromSlash(name))
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := osutil.SumFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Entry{
+		Path:    name,
+		Size:    info.Size(),
+		Mode:    info.Mode().Perm(),
+		ModTime: info.ModTime().UnixNano(),
+		Hash:    hash,
+	}, nil
+}
+
+// Load reads a manifest saved by Save. If the file does not exist, an
+// empty manifest is returned.
+func Load(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return New(), nil
+		}
+		return nil, err
+	}
+	m := New()
+	err = json.Unmarshal(data, m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode manifest %s: %v", path, err)
+	}
+	if m.Files == nil {
+		m.Files = make(map[string]*Entry)
+	}
+	return m, nil
+}
+
+func (m *Manifest) Save(path string) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+type Op string
+
+const (
+	OpAdd    Op = "add"
+	OpChange Op = "change"
+	OpRemove Op = "remove"
+	OpRename Op = "rename"
+)
+
+// Change is a difference between two manifests. For OpRename, From is
+// the old path and Entry is the file at the new path. For OpRemove,
+// Entry is the removed file.
+type Change struct {
+	Op    Op
+	From  string
+	Entry *Entry
+}
+
+func (c *Change) Path() string {
+	return c.Entry.Path
+}
+
+// Diff returns the changes needed to turn old into cur. A removed file
+// whose content shows up under a new path is reported as a rename, so
+// that the content does not need to be transferred again.
+func Diff(old, cur *Manifest) []*Change {
+	var changes []*Change
+	var added []*Entry
+	removed := make(map[string][]*Entry)
+
+	for name, e := range cur.Files {
+		o := old.Files[name]
+		switch {
+		case o == nil:
+			added = append(added, e)
+
+		case o.Hash != e.Hash || o.Mode != e.Mode:
+			changes = append(changes, &Change{Op: OpChange, Entry: e})
+		}
+	}
+	for name, o := range old.Files {
+		if _, ok := cur.Files[name]; !ok {
+			removed[o.Hash] = append(removed[o.Hash], o)
+		}
+	}
+	for hash := range removed {
+		entries := removed[hash]
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Path < entries[j].Path
+		})
+	}
+
+	sort.Slice(added, func(i, j int) bool {
+		return added[i].Path < added[j].Path
+	})
+	for _, e := range added {
+		candidates := removed[e.Hash]
+		if len(candidates) == 0 {
+			changes = append(changes, &Change{Op: OpAdd, Entry: e})
+			continue
+		}
+		from := candidates[0]
+		removed[e.Hash] = candidates[1:]
+		changes = append(changes, &Change{
+			Op:    OpRename,
+			From:  from.Path,
+			Entry: e,
+		})
+	}
+	for _, entries := range removed {
+		for _, e := range entries {
+			changes = append(changes, &Change{Op: OpRemove, Entry: e})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path() < changes[j].Path()
+	})
+	return changes
+}
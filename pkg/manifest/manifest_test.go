@@ -0,0 +1,98 @@
+package manifest
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	old := &Manifest{Files: map[string]*Entry{
+		"a.txt":     {Path: "a.txt", Hash: "1"},
+		"b.txt":     {Path: "b.txt", Hash: "2"},
+		"c.txt":     {Path: "c.txt", Hash: "3"},
+		"dir/d.txt": {Path: "dir/d.txt", Hash: "4"},
+	}}
+	cur := &Manifest{Files: map[string]*Entry{
+		"a.txt":     {Path: "a.txt", Hash: "1"},
+		"b.txt":     {Path: "b.txt", Hash: "22"},
+		"dir/e.txt": {Path: "dir/e.txt", Hash: "4"},
+		"f.txt":     {Path: "f.txt", Hash: "5"},
+	}}
+
+	changes := Diff(old, cur)
+	var result []string
+	for _, c := range changes {
+		line := string(c.Op) + " " + c.Path()
+		if c.From != "" {
+			line += " " + c.From
+		}
+		result = append(result, line)
+	}
+	expect := []string{
+		"change b.txt",
+		"remove c.txt",
+		"rename dir/e.txt dir/d.txt",
+		"add f.txt",
+	}
+	if !reflect.DeepEqual(result, expect) {
+		t.Fatalf("unexpect diff result: %v", result)
+	}
+}
+
+func TestBuild(t *testing.T) {
+	root := t.TempDir()
+	err := os.MkdirAll(filepath.Join(root, "sub"), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(root, "sub", "a.txt"), []byte("hello"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := Build(root, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := m.Files["sub/a.txt"]
+	if e == nil {
+		t.Fatal("expect sub/a.txt in manifest")
+	}
+	if e.Size != 5 || e.Hash == "" {
+		t.Fatalf("unexpect entry: %+v", e)
+	}
+
+	path := filepath.Join(root, "manifest")
+	err = m.Save(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, m) {
+		t.Fatal("unexpect loaded manifest")
+	}
+}
+
+func TestVersion(t *testing.T) {
+	a := Version{}.Bump("a")
+	b := a.Bump("b")
+	if b.Compare(a) != OrderAfter || a.Compare(b) != OrderBefore {
+		t.Fatal("expect b after a")
+	}
+	c := a.Bump("c")
+	if b.Compare(c) != OrderConcurrent {
+		t.Fatal("expect b and c concurrent")
+	}
+	merged := b.Merge(c)
+	if merged.Compare(b) != OrderAfter || merged.Compare(c) != OrderAfter {
+		t.Fatal("expect merged after b and c")
+	}
+	if merged.Compare(c.Merge(b)) != OrderEqual {
+		t.Fatal("expect merge to be commutative")
+	}
+}
@@ -0,0 +1,62 @@
+package manifest
+
+// Version is a version vector, it records how many times each client
+// has changed a file. It is used to tell whether two changes happened
+// one after another, or concurrently (a conflict).
+type Version map[string]uint64
+
+type Order int
+
+const (
+	OrderEqual Order = iota
+	OrderBefore
+	OrderAfter
+	OrderConcurrent
+)
+
+// Bump returns a copy of the version with the counter of client
+// increased.
+func (v Version) Bump(client string) Version {
+	nv := v.Merge(nil)
+	nv[client]++
+	return nv
+}
+
+// Merge returns a new version that has the max counter of each client in
+// both versions.
+func (v Version) Merge(o Version) Version {
+	nv := make(Version, len(v)+len(o))
+	for client, n := range v {
+		nv[client] = n
+	}
+	for client, n := range o {
+		if n > nv[client] {
+			nv[client] = n
+		}
+	}
+	return nv
+}
+
+// Compare tells the order of v relative to o.
+func (v Version) Compare(o Version) Order {
+	var before, after bool
+	for client, n := range v {
+		if n > o[client] {
+			after = true
+		}
+	}
+	for client, n := range o {
+		if n > v[client] {
+			before = true
+		}
+	}
+	switch {
+	case before && after:
+		return OrderConcurrent
+	case before:
+		return OrderBefore
+	case after:
+		return OrderAfter
+	}
+	return OrderEqual
+}
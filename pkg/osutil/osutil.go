@@ -80,15 +80,45 @@ func Sum(data []byte) string {
 	return hex.EncodeToString(sum[:])
 }
 
-func WalkDirs(root string) ([]string, error) {
+// SumFile is the same as Sum, but reads data from a file without loading
+// the whole file into memory.
+func SumFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// WalkDirs returns the root and all directories under it. If skip is not
+// nil, it is called with the slash separated path relative to the root,
+// and the directories it reports are skipped with their sub directories.
+func WalkDirs(root string, skip func(path string, dir bool) bool) ([]string, error) {
 	var dirs []string
 	err := filepath.Walk(root, func(path string, info fs.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		if info.IsDir() {
-			dirs = append(dirs, path)
+		if !info.IsDir() {
+			return nil
+		}
+		if skip != nil && path != root {
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			if skip(filepath.ToSlash(rel), true) {
+				return filepath.SkipDir
+			}
 		}
+		dirs = append(dirs, path)
 		return nil
 	})
 	return dirs, err
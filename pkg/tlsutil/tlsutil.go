@@ -0,0 +1,169 @@
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/fioncat/wshare/config"
+	"github.com/fioncat/wshare/pkg/log"
+	"github.com/fioncat/wshare/pkg/osutil"
+)
+
+const selfSignedValidity = time.Hour * 24 * 365
+
+// ServerConfig creates the tls config for the server.
+func ServerConfig(cfg *config.TLS) (*tls.Config, error) {
+	certFile, keyFile := os.ExpandEnv(cfg.Cert), os.ExpandEnv(cfg.Key)
+	if certFile == "" && keyFile == "" {
+		if !cfg.SelfSigned {
+			return nil, errors.New("tls cert and key are required, or enable self_signed for development")
+		}
+		var err error
+		certFile, keyFile, err = ensureSelfSigned()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate self-signed cert: %v", err)
+		}
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tls cert: %v", err)
+	}
+
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if cfg.Mutual {
+		if cfg.CA == "" {
+			return nil, errors.New("tls ca is required to verify clients in mutual mode")
+		}
+		pool, err := loadCA(cfg.CA)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsCfg, nil
+}
+
+// ClientConfig creates the tls config for the client.
+func ClientConfig(cfg *config.TLS) (*tls.Config, error) {
+	tlsCfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if cfg.CA != "" {
+		pool, err := loadCA(cfg.CA)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.RootCAs = pool
+	}
+	if cfg.SelfSigned {
+		// The server generates the cert itself in development mode, we
+		// cannot verify it.
+		log.Get().Warn("tls self_signed is enabled, skip verifying the server certificate")
+		tlsCfg.InsecureSkipVerify = true
+	}
+	if cfg.Mutual {
+		if cfg.Cert == "" || cfg.Key == "" {
+			return nil, errors.New("tls cert and key are required in mutual mode")
+		}
+		cert, err := tls.LoadX509KeyPair(os.ExpandEnv(cfg.Cert), os.ExpandEnv(cfg.Key))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load tls cert: %v", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return tlsCfg, nil
+}
+
+func loadCA(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(os.ExpandEnv(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tls ca: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in tls ca %s", path)
+	}
+	return pool, nil
+}
+
+// ensureSelfSigned returns the self-signed cert and key files, they are
+// generated if not exist or expired.
+func ensureSelfSigned() (string, string, error) {
+	certFile, err := config.LocalFile("tls-self-signed.crt")
+	if err != nil {
+		return "", "", err
+	}
+	keyFile, err := config.LocalFile("tls-self-signed.key")
+	if err != nil {
+		return "", "", err
+	}
+
+	exists, err := osutil.FileExists(certFile)
+	if err != nil {
+		return "", "", err
+	}
+	if exists {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err == nil && cert.Leaf == nil && len(cert.Certificate) > 0 {
+			cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		}
+		if err == nil && time.Now().Before(cert.Leaf.NotAfter) {
+			return certFile, keyFile, nil
+		}
+	}
+
+	log.Get().Warnf("generate self-signed tls cert %s, only use it for development", certFile)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", err
+	}
+	hostname, _ := os.Hostname()
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "wshare-server"},
+		DNSNames:     []string{"localhost", hostname},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(selfSignedValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	err = os.WriteFile(keyFile, keyPem, 0600)
+	if err != nil {
+		return "", "", err
+	}
+	err = os.WriteFile(certFile, certPem, 0644)
+	if err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, nil
+}
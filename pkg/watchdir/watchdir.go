@@ -23,9 +23,14 @@ type Notify struct {
 	logger *logrus.Entry
 
 	recursive bool
+
+	skip func(path string, dir bool) bool
 }
 
-func NewNotify(rootDir string, rec bool) (*Notify, error) {
+// NewNotify creates a Notify for rootDir. If rec is true, the sub
+// directories are watched too, except those reported by skip (can be
+// nil, see osutil.WalkDirs).
+func NewNotify(rootDir string, rec bool, skip func(path string, dir bool) bool) (*Notify, error) {
 	var err error
 	if !filepath.IsAbs(rootDir) {
 		rootDir, err = filepath.Abs(rootDir)
@@ -54,6 +59,7 @@ func NewNotify(rootDir string, rec bool) (*Notify, error) {
 		watcher:   w,
 		logger:    logger,
 		recursive: rec,
+		skip:      skip,
 	}
 	if rec {
 		err = n.flushDir()
@@ -97,7 +103,7 @@ func (n *Notify) listen() {
 }
 
 func (n *Notify) flushDir() error {
-	subDirs, err := osutil.WalkDirs(n.rootDir)
+	subDirs, err := osutil.WalkDirs(n.rootDir, n.skip)
 	if err != nil {
 		return err
 	}
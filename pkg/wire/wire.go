@@ -0,0 +1,175 @@
+// Package wire implements the field encoding of the wire format, see
+// docs/protocol.md.
+//
+// A message is a sequence of fields, each field is:
+//
+//	tag (uvarint) | length (uvarint) | value (length bytes)
+//
+// Integers are encoded as uvarint in the value, signed integers are
+// zigzag encoded first. Lists are encoded as repeated fields with the same
+// tag. Fields with zero values are omitted, and unknown tags are skipped by
+// the decoders, so fields can be added without breaking old clients.
+package wire
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Encoder appends fields to a buffer.
+type Encoder struct {
+	buf []byte
+}
+
+// Bytes returns the encoded fields.
+func (e *Encoder) Bytes() []byte {
+	return e.buf
+}
+
+func (e *Encoder) Raw(tag uint64, value []byte) {
+	if len(value) == 0 {
+		return
+	}
+	e.buf = binary.AppendUvarint(e.buf, tag)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(value)))
+	e.buf = append(e.buf, value...)
+}
+
+func (e *Encoder) String(tag uint64, value string) {
+	e.Raw(tag, []byte(value))
+}
+
+func (e *Encoder) Strings(tag uint64, values []string) {
+	for _, value := range values {
+		e.buf = binary.AppendUvarint(e.buf, tag)
+		e.buf = binary.AppendUvarint(e.buf, uint64(len(value)))
+		e.buf = append(e.buf, value...)
+	}
+}
+
+func (e *Encoder) Uint(tag uint64, value uint64) {
+	if value == 0 {
+		return
+	}
+	e.Raw(tag, binary.AppendUvarint(nil, value))
+}
+
+func (e *Encoder) Int(tag uint64, value int64) {
+	if value == 0 {
+		return
+	}
+	e.Raw(tag, binary.AppendVarint(nil, value))
+}
+
+// readStep is the max size allocated ahead of the data read, so that a
+// forged length does not make us allocate much.
+const readStep = 64 << 10
+
+// Decoder reads fields from a reader.
+type Decoder struct {
+	r *bufio.Reader
+
+	// max is the max length of a field.
+	max uint64
+}
+
+// NewDecoder creates a decoder, the fields longer than max are rejected.
+func NewDecoder(r io.Reader, max int64) *Decoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Decoder{r: br, max: uint64(max)}
+}
+
+// Next reads the next field, returns io.EOF if there is no more field.
+func (d *Decoder) Next() (uint64, []byte, error) {
+	tag, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return 0, nil, err
+	}
+	size, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return 0, nil, unexpectEOF(err)
+	}
+	if size > d.max {
+		return 0, nil, fmt.Errorf("field %d is too large (%d bytes)", tag, size)
+	}
+	value, err := d.read(size)
+	if err != nil {
+		return 0, nil, unexpectEOF(err)
+	}
+	return tag, value, nil
+}
+
+// read reads size bytes in steps, the buffer only grows with the data
+// read.
+func (d *Decoder) read(size uint64) ([]byte, error) {
+	step := size
+	if step > readStep {
+		step = readStep
+	}
+	value := make([]byte, 0, step)
+	for uint64(len(value)) < size {
+		n := size - uint64(len(value))
+		if n > readStep {
+			n = readStep
+		}
+		start := len(value)
+		value = append(value, make([]byte, n)...)
+		_, err := io.ReadFull(d.r, value[start:])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return value, nil
+}
+
+// Decode calls fn with each field, until the end of the reader.
+func (d *Decoder) Decode(fn func(tag uint64, value []byte) error) error {
+	for {
+		tag, value, err := d.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = fn(tag, value)
+		if err != nil {
+			return fmt.Errorf("invalid field %d: %v", tag, err)
+		}
+	}
+}
+
+// Unmarshal calls fn with each field in data.
+func Unmarshal(data []byte, fn func(tag uint64, value []byte) error) error {
+	return NewDecoder(bytes.NewReader(data), int64(len(data))).Decode(fn)
+}
+
+func Uint(value []byte) (uint64, error) {
+	v, n := binary.Uvarint(value)
+	if n <= 0 || n != len(value) {
+		return 0, errors.New("invalid uint")
+	}
+	return v, nil
+}
+
+func Int(value []byte) (int64, error) {
+	v, n := binary.Varint(value)
+	if n <= 0 || n != len(value) {
+		return 0, errors.New("invalid int")
+	}
+	return v, nil
+}
+
+func unexpectEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
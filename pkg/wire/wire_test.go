@@ -0,0 +1,76 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestWire(t *testing.T) {
+	var e Encoder
+	e.String(1, "hello")
+	e.Uint(2, 300)
+	e.Int(3, -5)
+	e.Strings(4, []string{"a", "b"})
+	e.Raw(100, []byte("unknown"))
+	e.String(5, "")
+
+	var (
+		s     string
+		u     uint64
+		i     int64
+		items []string
+	)
+	err := Unmarshal(e.Bytes(), func(tag uint64, value []byte) error {
+		var err error
+		switch tag {
+		case 1:
+			s = string(value)
+		case 2:
+			u, err = Uint(value)
+		case 3:
+			i, err = Int(value)
+		case 4:
+			items = append(items, string(value))
+		case 5:
+			t.Fatal("expect empty field to be omitted")
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "hello" || u != 300 || i != -5 || !reflect.DeepEqual(items, []string{"a", "b"}) {
+		t.Fatalf("unexpect result: %q %d %d %v", s, u, i, items)
+	}
+
+	err = Unmarshal(e.Bytes()[:len(e.Bytes())-3], func(uint64, []byte) error { return nil })
+	if err == nil {
+		t.Fatal("expect error for truncated data")
+	}
+
+	d := NewDecoder(bytes.NewReader(e.Bytes()), 3)
+	_, _, err = d.Next()
+	if err == nil {
+		t.Fatal("expect error for too large field")
+	}
+
+	big := bytes.Repeat([]byte("x"), readStep*3+1)
+	e = Encoder{}
+	e.Raw(1, big)
+	_, value, err := NewDecoder(bytes.NewReader(e.Bytes()), 1<<30).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, big) {
+		t.Fatal("unexpect large field")
+	}
+
+	// A forged length larger than the data.
+	forged := binary.AppendUvarint([]byte{1}, 1<<30)
+	_, _, err = NewDecoder(bytes.NewReader(forged), 1<<31).Next()
+	if err == nil {
+		t.Fatal("expect error for forged length")
+	}
+}
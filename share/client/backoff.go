@@ -0,0 +1,51 @@
+package client
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	retryDialMinPeriod = time.Second
+	retryDialMaxPeriod = time.Minute
+)
+
+// backoff is the exponential backoff of redialing. The period is doubled
+// after each failure, up to max, and jittered so that the clients do not
+// redial at the same time after the server restarts.
+type backoff struct {
+	min time.Duration
+	max time.Duration
+
+	period time.Duration
+
+	rand *rand.Rand
+}
+
+func newBackoff(min, max time.Duration) *backoff {
+	return &backoff{
+		min:  min,
+		max:  max,
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// next returns the period to wait before the next dial.
+func (b *backoff) next() time.Duration {
+	if b.period == 0 {
+		b.period = b.min
+	} else {
+		b.period *= 2
+		if b.period > b.max {
+			b.period = b.max
+		}
+	}
+	// Wait at least half of the period.
+	half := b.period / 2
+	return half + time.Duration(b.rand.Int63n(int64(half)+1))
+}
+
+// reset is called after connected.
+func (b *backoff) reset() {
+	b.period = 0
+}
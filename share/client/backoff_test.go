@@ -0,0 +1,21 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := newBackoff(time.Second, 10*time.Second)
+	for i, period := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		period *= time.Second
+		d := b.next()
+		if d < period/2 || d > period {
+			t.Fatalf("unexpect backoff %v at %d, expect in [%v, %v]", d, i, period/2, period)
+		}
+	}
+	b.reset()
+	if d := b.next(); d > time.Second {
+		t.Fatalf("unexpect backoff %v after reset", d)
+	}
+}
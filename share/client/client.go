@@ -1,59 +1,277 @@
 package client
 
 import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"reflect"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/fioncat/wshare/config"
+	"github.com/fioncat/wshare/pkg/crypto"
 	"github.com/fioncat/wshare/pkg/log"
+	"github.com/fioncat/wshare/pkg/tlsutil"
 	"github.com/fioncat/wshare/share"
+	"github.com/fioncat/wshare/share/transfer"
 	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
 )
 
-const (
-	retryDialMinPeriodSeconds = 3
-	retryDialMaxPeriodSeconds = 20
-)
+// errAuth is returned by dial when the server rejects us, retrying won't
+// help.
+var errAuth = errors.New("authentication failed")
+
+// errProtocol is returned by dial when there is no common protocol version
+// with the server, retrying won't help either.
+var errProtocol = errors.New("protocol negotiation failed")
 
 type Client struct {
-	header http.Header
+	name string
 
 	history *share.History
 
-	url string
+	url     string
+	httpURL string
+
+	// identity is the key pair of the device, nil if pairing is not
+	// enabled.
+	identity *crypto.Identity
+
+	dialer     *websocket.Dialer
+	httpClient *http.Client
+
+	chunkSize int
+
+	compressThreshold int
+
+	// maxSize is the max size of a payload received.
+	maxSize int64
+
+	heartbeat *transfer.Heartbeat
+
+	deliveries *deliveries
+
+	rooms []*roomConn
+}
+
+// roomConn is the connection to a room. Each room is an independent
+// connection, with its own key and transfers.
+type roomConn struct {
+	*Client
+
+	room   *share.Room
+	header http.Header
+	logger *logrus.Entry
+
+	receiver *transfer.Receiver
+	outbox   *transfer.Outbox
+	replay   *transfer.ReplayWindow
+
+	// pins is the path of the devices pinned in the room, empty if pairing
+	// is not enabled, see share.E2E.
+	pins string
+
+	// e2e is nil if end-to-end encryption is not enabled.
+	e2e *share.E2E
+
+	// pending is the packets from handlers to send to the room.
+	pending *pending
+
+	// reconnect triggers dialing again now, see Client.Reconnect.
+	reconnect chan struct{}
+
+	stateMu sync.Mutex
+	state   connState
+
+	// backoff is reset after connected, see dial.
+	backoff *backoff
+
+	// control receives the resume and query frames, they are handled in
+	// the sending loop, since only one goroutine can write to the
+	// connection.
+	control chan *share.Frame
+
+	// receipts is the receipts to send, see share.FrameReceipt.
+	receipts chan *share.Frame
+
+	// roster is the other clients in the room by id, from the presence
+	// frames. It is only used by the receiving goroutine.
+	roster map[string]*share.Presence
 }
 
 func New() (*Client, error) {
+	return newClient(false)
+}
+
+// NewSender creates a client to send packets once, see Send. It connects
+// as a sender, so that it doesn't take the name (and the queued messages)
+// of the running daemon.
+func NewSender() (*Client, error) {
+	return newClient(true)
+}
+
+func newClient(sendOnly bool) (*Client, error) {
+	wsScheme, httpScheme := "ws", "http"
+	dialer := *websocket.DefaultDialer
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsCfg := config.Get().TLS; tlsCfg.Enable {
+		wsScheme, httpScheme = "wss", "https"
+		clientTLS, err := tlsutil.ClientConfig(tlsCfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init tls: %v", err)
+		}
+		dialer.TLSClientConfig = clientTLS
+		// The transport adds h2 to the config, which breaks websocket, so
+		// it cannot share the config with the dialer.
+		transport.TLSClientConfig = clientTLS.Clone()
+	}
+
 	u := url.URL{
-		Scheme: "ws",
+		Scheme: wsScheme,
 		Host:   config.Get().Server,
 		Path:   "/share",
 	}
 	url := u.String()
-
-	var header http.Header
-	if config.Get().Name != "" {
-		header = http.Header{
-			"client-name": []string{config.Get().Name},
-		}
-	}
+	u.Scheme = httpScheme
+	u.Path = ""
+	httpURL := u.String()
 
 	his, err := share.OpenHistory()
 	if err != nil {
 		return nil, fmt.Errorf("failed to init history: %v", err)
 	}
 
-	return &Client{
-		header:  header,
-		history: his,
-		url:     url,
-	}, nil
+	chunkSize, err := transfer.ChunkSize()
+	if err != nil {
+		return nil, err
+	}
+	skew, err := transfer.ClockSkew()
+	if err != nil {
+		return nil, err
+	}
+	sealedMaxAge, err := transfer.SealedMaxAge(skew)
+	if err != nil {
+		return nil, err
+	}
+	compressThreshold, err := transfer.CompressThreshold()
+	if err != nil {
+		return nil, err
+	}
+	maxSize, err := transfer.MaxSize()
+	if err != nil {
+		return nil, err
+	}
+	heartbeat, err := transfer.LoadHeartbeat()
+	if err != nil {
+		return nil, err
+	}
+	offline, err := loadOfflinePolicies()
+	if err != nil {
+		return nil, err
+	}
+
+	rooms, err := share.ClientRooms()
+	if err != nil {
+		return nil, err
+	}
+	id, err := share.LoadClientID()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Get().E2E && (!config.Get().Pairing || config.Get().Name == "") {
+		return nil, errors.New("e2e requires pairing and name")
+	}
+	var identity *crypto.Identity
+	if config.Get().Pairing {
+		path, err := config.LocalFile("device.key")
+		if err != nil {
+			return nil, err
+		}
+		identity, err = crypto.LoadIdentity(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c := &Client{
+		name:       config.Get().Name,
+		history:    his,
+		url:        url,
+		httpURL:    httpURL,
+		identity:   identity,
+		dialer:     &dialer,
+		httpClient: &http.Client{Transport: transport, Timeout: time.Second * 30},
+		chunkSize:  chunkSize,
+
+		compressThreshold: compressThreshold,
+		maxSize:           maxSize,
+		heartbeat:         heartbeat,
+	}
+	if !sendOnly {
+		c.deliveries, err = newDeliveries()
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, room := range rooms {
+		header := http.Header{}
+		header.Set(share.HeaderClientID, id)
+		if c.name != "" {
+			header["client-name"] = []string{c.name}
+		}
+		if sendOnly {
+			header.Set(share.HeaderSendOnly, "true")
+		} else {
+			header.Set(share.HeaderClientVersion, share.BuildVersion())
+			header.Set(share.HeaderClientHandlers, share.FormatHandlers())
+		}
+		logger := logrus.NewEntry(log.Get())
+		if room.Name != "" {
+			header.Set(share.HeaderRoom, room.Name)
+			logger = logger.WithField("room", room.Name)
+		}
+		rc := &roomConn{
+			Client:   c,
+			room:     room,
+			header:   header,
+			logger:   logger,
+			receiver: transfer.NewReceiver(chunkSize, maxSize),
+			outbox:   transfer.NewOutbox(),
+			replay:   transfer.NewReplayWindow(skew, skew),
+			pending:  newPending(offline),
+			control:  make(chan *share.Frame, 100),
+			receipts: make(chan *share.Frame, 100),
+			roster:   make(map[string]*share.Presence),
+
+			reconnect: make(chan struct{}, 1),
+			backoff:   newBackoff(retryDialMinPeriod, retryDialMaxPeriod),
+		}
+		if identity != nil {
+			rc.pins, err = pinsFile(room.Name)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if config.Get().E2E {
+			replay := transfer.NewReplayWindow(sealedMaxAge, skew)
+			rc.e2e = share.NewE2E(c.name, identity, rc.pins, rc.fetchDevices, replay)
+		}
+		c.rooms = append(c.rooms, rc)
+	}
+	return c, nil
 }
 
-func (c *Client) Start() {
+// Start connects to the rooms and shares data. It only returns when a
+// server does not support our protocol version.
+func (c *Client) Start() error {
 	handlers := share.ListHandlers()
 	handlerNames := make([]string, 0, len(handlers))
 	selectCases := make([]reflect.SelectCase, 0, len(handlers)+1)
@@ -66,104 +284,531 @@ func (c *Client) Start() {
 			Chan: reflect.ValueOf(ch),
 		})
 	}
-	selectCases = append(selectCases, reflect.SelectCase{})
 
+	errCh := make(chan error, len(c.rooms))
+	for _, rc := range c.rooms {
+		go func(rc *roomConn) {
+			errCh <- rc.run()
+		}(rc)
+	}
+	errIdx := len(selectCases)
+	selectCases = append(selectCases, reflect.SelectCase{
+		Dir:  reflect.SelectRecv,
+		Chan: reflect.ValueOf(errCh),
+	})
+
+	for {
+		chosen, value, _ := reflect.Select(selectCases)
+		if chosen == errIdx {
+			return value.Interface().(error)
+		}
+
+		pack := value.Interface().(*share.Packet)
+		pack.Type = handlerNames[chosen]
+		if len(pack.To) == 0 {
+			pack.To = config.Get().Targets[pack.Type]
+		}
+		for _, rc := range c.rooms {
+			dropped := rc.pending.push(pack, rc.connected())
+			if dropped > 0 {
+				rc.logger.Warnf("%s: not connected, drop %d packets", pack.Type, dropped)
+			}
+		}
+	}
+}
+
+// Reconnect makes the rooms dial the server again now, without waiting
+// for the backoff. The connected rooms are disconnected first, such as
+// after the network is changed.
+func (c *Client) Reconnect() {
+	for _, rc := range c.rooms {
+		select {
+		case rc.reconnect <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Send connects to the rooms, sends the packet, and disconnects.
+func (c *Client) Send(pack *share.Packet) error {
+	for _, rc := range c.rooms {
+		conn, err := rc.tryDial()
+		if err != nil {
+			return fmt.Errorf("failed to dial server: %v", err)
+		}
+		err = rc.send(conn, pack)
+		msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+		conn.WriteMessage(websocket.CloseMessage, msg)
+		conn.Close()
+		if err != nil {
+			return fmt.Errorf("failed to send data to server: %v", err)
+		}
+		size := log.BytesSize(pack.Data)
+		rc.logger.Infof("%s: send %s data to server", pack.Type, size)
+	}
+	return nil
+}
+
+func (rc *roomConn) run() error {
 reentry:
-	conn := c.dial()
+	conn, err := rc.dial()
+	if err != nil {
+		return err
+	}
+	if rc.e2e != nil {
+		err = rc.e2e.Refresh()
+		if err != nil {
+			rc.logger.Warn(err)
+		}
+	}
+	stopHeartbeat := rc.heartbeat.Start(conn, nil)
+	rc.resume(conn)
 
+	// replaced is set before done is closed, see share.CloseReplaced.
+	var replaced bool
 	done := make(chan struct{})
-	selectCases[len(selectCases)-1] = reflect.SelectCase{
-		Dir:  reflect.SelectRecv,
-		Chan: reflect.ValueOf(done),
-	}
 	go func() {
 		defer close(done)
-		log.Get().Info("begin to recv message")
+		// Break the writes of the sending loop if they are blocked by a
+		// dead connection.
+		defer conn.Close()
+		rc.logger.Info("begin to recv message")
 		for {
 			mt, data, err := conn.ReadMessage()
+			if transfer.IsTimeout(err) {
+				rc.logger.Warnf("no heartbeat from server in %v, reconnect", rc.heartbeat.Timeout)
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				// Closed by us, such as reconnecting.
+				return
+			}
+			if websocket.IsCloseError(err, share.CloseReplaced) {
+				rc.logger.Error("replaced by another connection with the same client id, it may be a " +
+					"copy of this client, please remove its client.id file, then run \"wshared reconnect\"")
+				replaced = true
+				return
+			}
 			if err != nil {
-				log.Get().Errorf("failed to recv message from server: %v", err)
+				rc.logger.Errorf("failed to recv message from server: %v", err)
 				return
 			}
+			rc.heartbeat.Alive(conn)
 			if mt != websocket.BinaryMessage {
 				continue
 			}
 
-			pack, err := share.DecodePack(data)
+			frame, pack, sender, err := rc.recvFrame(data)
 			if err != nil {
-				log.Get().Error(err)
+				rc.logger.Error(err)
+				continue
+			}
+			if pack == nil {
+				// The transfer is not completed yet.
 				continue
 			}
 
 			if pack.Type == "" {
-				log.Get().Warn("recv an invalid packet without type, discarded it")
+				rc.logger.Warn("recv an invalid packet without type, discarded it")
 				continue
 			}
 
 			handler := share.GetHandler(pack.Type)
 			if handler == nil {
-				log.Get().Warnf("recv an invalid packet with an unknown type %q, discarded it", pack.Type)
+				rc.logger.Warnf("recv an invalid packet with an unknown type %q, discarded it", pack.Type)
 				continue
 			}
 
-			entry := log.Get().WithField("handler", pack.Type)
+			origin := frame.Origin()
+			entry := rc.logger.WithField("handler", pack.Type)
+			if sender != nil {
+				entry = entry.WithField("sender", sender.Name)
+			} else if origin.Client != "" {
+				entry = entry.WithField("from", origin.Client)
+			}
 			size := log.BytesSize(pack.Data)
 			entry.Infof("recv %s data from server, meta: %s", size, string(pack.Metadata))
 			ctx := &share.Context{
 				Entry:   entry,
-				History: c.history,
+				History: rc.history,
 				Pack:    pack,
+				Sender:  sender,
+				Origin:  origin,
 			}
 			err = handler.Recv(ctx)
 			if err != nil {
 				entry.Errorf("failed to handle packet: %v", err)
-				continue
 			}
+			rc.sendReceipt(frame, err)
 		}
 	}()
 
 	for {
-		chosen, value, _ := reflect.Select(selectCases)
-		if chosen == len(selectCases)-1 {
+		select {
+		case <-done:
+			stopHeartbeat()
+			conn.Close()
+			if replaced {
+				rc.setState(stateReplaced)
+				<-rc.reconnect
+				rc.logger.Info("reconnect to server")
+			}
 			goto reentry
+
+		case frame := <-rc.control:
+			err := rc.handleControl(conn, frame)
+			if err != nil {
+				rc.logger.Errorf("failed to handle %s frame: %v", frame.Kind, err)
+			}
+
+		case frame := <-rc.receipts:
+			err := rc.sendFrame(conn, frame)
+			if err != nil {
+				rc.logger.Errorf("failed to send receipt: %v", err)
+			}
+
+		case <-rc.reconnect:
+			rc.logger.Info("reconnect to server")
+			stopHeartbeat()
+			conn.Close()
+			<-done
+			goto reentry
+
+		case <-rc.pending.ready:
+			for _, pack := range rc.pending.pop() {
+				err := rc.send(conn, pack)
+				if errors.Is(err, share.ErrNoRecipient) {
+					rc.logger.Debugf("%s: no device to send data to", pack.Type)
+					continue
+				}
+				if err != nil {
+					rc.logger.Errorf("failed to send data to server: %v", err)
+					continue
+				}
+				size := log.BytesSize(pack.Data)
+				rc.logger.Infof("%s: send %s data to server, meta: %s", pack.Type, size, string(pack.Metadata))
+			}
 		}
+	}
+}
 
-		handler := handlerNames[chosen]
-		pack := value.Interface().(*share.Packet)
-		pack.Type = handler
+func (rc *roomConn) send(conn *websocket.Conn, pack *share.Packet) error {
+	payload, err := pack.Encode(rc.e2e, rc.compressThreshold)
+	if errors.Is(err, share.ErrNoRecipient) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode packet: %v", err)
+	}
+	if payload.Flags&share.FlagGzip != 0 {
+		rc.logger.Debugf("%s: compress %s to %s, ratio %.1f%%", pack.Type, log.Size(int64(payload.Size)),
+			log.BytesSize(payload.Data), float64(len(payload.Data))*100/float64(payload.Size))
+	}
 
-		data, err := pack.Encode()
+	frames := transfer.Split(payload.Data, rc.chunkSize)
+	for _, frame := range frames {
+		frame.To = pack.To
+		frame.Flags = payload.Flags
+	}
+	rc.deliveries.add(&Delivery{
+		ID:       frames[0].ID,
+		Type:     pack.Type,
+		Room:     rc.room.Name,
+		Size:     int64(len(pack.Data)),
+		Time:     time.Now(),
+		Receipts: make(map[string]*Receipt),
+	})
+	rc.outbox.Add(frames)
+	return rc.sendFrames(conn, frames)
+}
+
+func (rc *roomConn) sendFrames(conn *websocket.Conn, frames []*share.Frame) error {
+	for _, frame := range frames {
+		err := rc.sendFrame(conn, frame)
 		if err != nil {
-			log.Get().Errorf("failed to encode packet: %v", err)
-			continue
+			return err
 		}
+		if frame.Kind == share.FrameChunk {
+			rc.outbox.Sent(frame)
+		}
+	}
+	return nil
+}
+
+func (rc *roomConn) sendFrame(conn *websocket.Conn, frame *share.Frame) error {
+	data, err := frame.Encode(rc.room.Key)
+	if err != nil {
+		return fmt.Errorf("failed to encode frame: %v", err)
+	}
+	return conn.WriteMessage(websocket.BinaryMessage, data)
+}
 
-		err = conn.WriteMessage(websocket.BinaryMessage, data)
+// resume is called after reconnecting. It sends the frames that were not
+// written because of the disconnection, and asks receivers which chunks
+// they have, so that only the missing ones are resent. Then it tells the
+// senders which chunks we have for our incomplete transfers.
+func (rc *roomConn) resume(conn *websocket.Conn) {
+	for id, frames := range rc.outbox.Unsent() {
+		rc.logger.Infof("resume sending transfer %s, %d frames left", id, len(frames))
+		frames = append(frames, rc.outbox.Query(id))
+		err := rc.sendFrames(conn, frames)
 		if err != nil {
-			log.Get().Errorf("failed to send data to server: %v", err)
-			continue
+			rc.logger.Errorf("failed to resume transfer %s: %v", id, err)
+			return
+		}
+	}
+	for _, frame := range rc.receiver.Resumes() {
+		rc.logger.Infof("resume receiving transfer %s, %d chunks received", frame.ID, len(frame.Received))
+		err := rc.sendFrame(conn, frame)
+		if err != nil {
+			rc.logger.Errorf("failed to resume transfer %s: %v", frame.ID, err)
+			return
 		}
-		size := log.BytesSize(pack.Data)
-		log.Get().Infof("%s: send %s data to server, meta: %s", pack.Type, size, string(pack.Metadata))
 	}
 }
 
-func (c *Client) dial() *websocket.Conn {
-	retrySeconds := retryDialMinPeriodSeconds
-	for {
-		conn, _, err := websocket.DefaultDialer.Dial(c.url, c.header)
+func (rc *roomConn) handleControl(conn *websocket.Conn, frame *share.Frame) error {
+	switch frame.Kind {
+	case share.FrameResume:
+		frames := rc.outbox.Missing(frame)
+		if len(frames) == 0 {
+			return nil
+		}
+		rc.logger.Infof("resend %d frames for transfer %s", len(frames), frame.ID)
+		return rc.sendFrames(conn, frames)
+
+	case share.FrameQuery:
+		resume := rc.receiver.Resume(frame)
+		if resume == nil {
+			return nil
+		}
+		return rc.sendFrame(conn, resume)
+	}
+	return nil
+}
+
+// recvFrame adds a frame to the receiver, and returns the last frame, the
+// packet and its verified sender when the transfer is completed. If not,
+// the packet is nil.
+func (rc *roomConn) recvFrame(data []byte) (*share.Frame, *share.Packet, *share.Sender, error) {
+	frame, err := share.DecodeFrame(rc.room.Key, data)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	err = rc.replay.Check(frame)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	switch frame.Kind {
+	case share.FrameChunk:
+
+	case share.FrameResume, share.FrameQuery:
+		select {
+		case rc.control <- frame:
+		default:
+			rc.logger.Warnf("too many control frames, discard %s frame", frame.Kind)
+		}
+		return frame, nil, nil, nil
+
+	case share.FrameAck:
+		rc.logger.Debugf("transfer %s is received by server, delivered to %v", frame.ID, frame.To)
+		rc.deliveries.ack(frame)
+		rc.outbox.Acked(frame)
+		return frame, nil, nil, nil
+
+	case share.FrameReceipt:
+		if frame.Error != "" {
+			rc.logger.Warnf("transfer %s failed on %s: %s", frame.ID, frame.From, frame.Error)
+		} else {
+			rc.logger.Debugf("transfer %s is handled by %s", frame.ID, frame.From)
+		}
+		rc.deliveries.receipt(frame)
+		rc.outbox.Receipt(frame)
+		return frame, nil, nil, nil
+
+	case share.FramePresence:
+		var p share.Presence
+		err = p.UnmarshalBinary(frame.Data)
 		if err != nil {
-			log.Get().Errorf("failed to dial server: %v, we will retry in %d seconds", err, retrySeconds)
-			time.Sleep(time.Second * time.Duration(retrySeconds))
-			// Increment retrySeconds, so that if the server is
-			// disconnected for a long time, do not retry too much.
-			// But retrySeconds won't be bigger than max threshold.
-			if retrySeconds <= retryDialMaxPeriodSeconds {
-				retrySeconds++
-			}
+			return nil, nil, nil, fmt.Errorf("failed to decode presence: %v", err)
+		}
+		rc.updateRoster(&p)
+		return frame, nil, nil, nil
+
+	default:
+		return nil, nil, nil, fmt.Errorf("unknown frame kind %q", frame.Kind)
+	}
+
+	payload, err := rc.receiver.Add(frame)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to receive transfer %s: %v", frame.ID, err)
+	}
+	if payload == nil {
+		return frame, nil, nil, nil
+	}
+	defer payload.Close()
+	pack, sender, err := share.DecodePack(payload, frame.Flags, rc.maxSize, rc.e2e)
+	return frame, pack, sender, err
+}
+
+// sendReceipt tells the sender of the transfer the result of handling it.
+func (rc *roomConn) sendReceipt(frame *share.Frame, err error) {
+	if frame.From == "" || frame.From == rc.name {
+		// The sender does not have a name, we cannot reply to it.
+		return
+	}
+	receipt := &share.Frame{
+		Kind: share.FrameReceipt,
+		ID:   frame.ID,
+		To:   []string{frame.From},
+	}
+	if err != nil {
+		receipt.Error = err.Error()
+	}
+	select {
+	case rc.receipts <- receipt:
+	default:
+		rc.logger.Warnf("too many receipts, discard receipt of transfer %s", frame.ID)
+	}
+}
+
+// dial dials the server until connected, see connState. It only returns
+// an error when there is no common protocol version with the server.
+func (rc *roomConn) dial() (*websocket.Conn, error) {
+	for {
+		rc.setState(stateConnecting)
+		conn, err := rc.tryDial()
+		if err == nil {
+			rc.backoff.reset()
+			rc.setState(stateConnected)
+			rc.logger.Info("connected to server")
+			return conn, nil
+		}
+		if errors.Is(err, errProtocol) {
+			rc.logger.Errorf("%v, stop retrying", err)
+			return nil, err
+		}
+
+		// Take the trigger sent before, it is handled by this dial.
+		select {
+		case <-rc.reconnect:
+		default:
+		}
+		if errors.Is(err, errAuth) {
+			// Retrying won't help, until the password is changed or the
+			// device is approved.
+			rc.setState(stateAuthFailed)
+			rc.logger.Errorf("%v, please check the password (and pairing), then run \"wshared reconnect\"", err)
+			<-rc.reconnect
+			rc.logger.Info("reconnect to server")
 			continue
 		}
-		log.Get().Info("connected to server")
-		return conn
+
+		period := rc.backoff.next()
+		rc.setState(stateBackoff)
+		rc.logger.Errorf("failed to dial server: %v, we will retry in %v", err, period.Round(time.Millisecond))
+		select {
+		case <-time.After(period):
+		case <-rc.reconnect:
+			rc.logger.Info("reconnect to server")
+		}
+	}
+}
+
+// tryDial dials with the auth headers, see authHeader.
+func (rc *roomConn) tryDial() (*websocket.Conn, error) {
+	header, err := rc.authHeader(rc.url)
+	if err != nil {
+		return nil, err
+	}
+	header.Set(share.HeaderProtocol, share.FormatVersions(share.SupportedVersions))
+	conn, resp, err := rc.dialer.Dial(rc.url, header)
+	if err != nil {
+		if resp != nil {
+			switch resp.StatusCode {
+			case http.StatusUnauthorized:
+				return nil, authError(resp)
+
+			case http.StatusUpgradeRequired:
+				body, _ := io.ReadAll(resp.Body)
+				reason := strings.TrimSpace(string(body))
+				reason = strings.TrimPrefix(reason, errProtocol.Error()+": ")
+				return nil, fmt.Errorf("%w: %s", errProtocol, reason)
+			}
+		}
+		return nil, err
+	}
+	// The server must choose a version we support.
+	_, err = share.NegotiateVersion(resp.Header.Get(share.HeaderProtocol))
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%w: server: %v", errProtocol, err)
+	}
+	return conn, nil
+}
+
+// authHeader gets a nonce from the server, and returns the headers with
+// the nonce and its MAC, so that the server can check that we know the
+// password. If pairing is enabled, the nonce is also signed by the device
+// key.
+func (rc *roomConn) authHeader(rawURL string) (http.Header, error) {
+	nonce, server, err := rc.challenge(rc.room.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get challenge: %v", err)
+	}
+	kdfHeader, sum, err := rc.room.Key.AuthMAC(server, share.AuthMessage(nonce, rc.room.Name, rc.name, rc.header.Get(share.HeaderClientID)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid challenge: %v", err)
+	}
+	header := rc.header.Clone()
+	header.Set(share.HeaderAuthNonce, nonce)
+	header.Set(share.HeaderAuthMAC, hex.EncodeToString(sum))
+	header.Set(share.HeaderAuthKDF, base64.StdEncoding.EncodeToString(kdfHeader))
+
+	if rc.identity != nil {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		msg := share.SignMessage(nonce, rc.room.Name, rc.name, rc.header.Get(share.HeaderClientID), u.RequestURI())
+		header.Set(share.HeaderAuthDevice, base64.StdEncoding.EncodeToString(rc.identity.Public))
+		header.Set(share.HeaderAuthSignature, hex.EncodeToString(rc.identity.Sign(msg)))
+		header.Set(share.HeaderAuthBoxKey, base64.StdEncoding.EncodeToString(rc.identity.BoxPublic))
+		header.Set(share.HeaderAuthBoxKeySig, base64.StdEncoding.EncodeToString(rc.identity.BoxSignature()))
+	}
+	return header, nil
+}
+
+func authError(resp *http.Response) error {
+	body, _ := io.ReadAll(resp.Body)
+	reason := strings.TrimSpace(string(body))
+	reason = strings.TrimPrefix(reason, errAuth.Error()+": ")
+	return fmt.Errorf("%w: %s", errAuth, reason)
+}
+
+// challenge returns a nonce, and the crypto header of the server key to
+// derive the MAC key with.
+func (c *Client) challenge(room string) (string, []byte, error) {
+	query := url.Values{"room": {room}}
+	resp, err := c.httpClient.Get(c.httpURL + share.ChallengePath + "?" + query.Encode())
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return "", nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("server returns %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	nonce, encoded, ok := strings.Cut(string(body), "\n")
+	if !ok {
+		return "", nil, errors.New("missing key derivation parameters, the server may be too old")
+	}
+	server, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid key derivation parameters: %v", err)
 	}
+	return nonce, server, nil
 }
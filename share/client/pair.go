@@ -0,0 +1,333 @@
+package client
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/fioncat/wshare/config"
+	"github.com/fioncat/wshare/pkg/crypto"
+	"github.com/fioncat/wshare/share"
+	"github.com/fioncat/wshare/share/device"
+)
+
+const pairStatusInterval = time.Second * 2
+
+var (
+	errPairingDisabled = errors.New("pairing is not enabled, please set pairing to true in config")
+
+	errNotFound = errors.New("not found")
+)
+
+// Fingerprint returns the fingerprint of the device key.
+func (c *Client) Fingerprint() (string, error) {
+	if c.identity == nil {
+		return "", errPairingDisabled
+	}
+	return crypto.Fingerprint(c.identity.Public), nil
+}
+
+// Pair requests pairing this device in each room. For the rooms that need
+// approving, show is called with the code, then it waits until the code
+// is approved by a paired device, or expired.
+func (c *Client) Pair(show func(room *share.Room, code string)) error {
+	if c.identity == nil {
+		return errPairingDisabled
+	}
+	if c.name == "" {
+		return errors.New("name is required for pairing")
+	}
+	for _, rc := range c.rooms {
+		var req device.Request
+		err := rc.call(http.MethodPost, device.PathRequest, nil, &req)
+		if err != nil {
+			return fmt.Errorf("failed to request pairing in room %s: %v", rc.room.DisplayName(), err)
+		}
+		if req.Status != device.StatusApproved {
+			show(rc.room, req.Code)
+			err = rc.waitApproved(req.Code)
+			if err != nil {
+				return fmt.Errorf("failed to pair in room %s: %v", rc.room.DisplayName(), err)
+			}
+		}
+		// Pin the devices paired before us, the devices paired later are
+		// pinned by approving or trusting them.
+		devices, err := rc.fetchDevices()
+		if err != nil {
+			return fmt.Errorf("failed to list devices in room %s: %v", rc.room.DisplayName(), err)
+		}
+		err = rc.pin(false, devices...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Approve approves the device with the code, returns the device. The
+// pending device is passed to confirm with the device of the same name
+// already paired (nil if none), it is approved if confirm returns true. A
+// paired device is only replaced if replace is true.
+func (c *Client) Approve(code string, replace bool, confirm func(room *share.Room, d, old *device.Device) bool) (*device.Device, error) {
+	if c.identity == nil {
+		return nil, errPairingDisabled
+	}
+	query := url.Values{"code": []string{code}}
+	for _, rc := range c.rooms {
+		var d device.Device
+		err := rc.call(http.MethodGet, device.PathPending, query, &d)
+		if errors.Is(err, errNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		devices, err := rc.fetchDevices()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list devices in room %s: %v", rc.room.DisplayName(), err)
+		}
+		var old *device.Device
+		for _, paired := range devices {
+			if paired.Name == d.Name && !bytes.Equal(paired.Key, d.Key) {
+				old = paired
+			}
+		}
+		if old != nil && !replace {
+			return nil, fmt.Errorf("device %s with fingerprint %s is already paired in room %s, "+
+				"use --replace to replace it", old.Name, old.Fingerprint(), rc.room.DisplayName())
+		}
+		if !confirm(rc.room, &d, old) {
+			return nil, errors.New("approving is canceled")
+		}
+
+		approveQuery := url.Values{"code": []string{code}}
+		if replace {
+			approveQuery.Set("replace", "true")
+		}
+		var approved device.Device
+		err = rc.call(http.MethodPost, device.PathApprove, approveQuery, &approved)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(approved.Key, d.Key) {
+			return nil, errors.New("the device approved is not the one confirmed")
+		}
+		return &approved, rc.pin(replace, &approved)
+	}
+	return nil, errors.New("unknown or expired code")
+}
+
+// Trust pins the device paired by others, the fingerprint must match the
+// device on the server.
+func (c *Client) Trust(name, fingerprint string) error {
+	if c.identity == nil {
+		return errPairingDisabled
+	}
+	var trusted bool
+	for _, rc := range c.rooms {
+		devices, err := rc.fetchDevices()
+		if err != nil {
+			return fmt.Errorf("failed to list devices in room %s: %v", rc.room.DisplayName(), err)
+		}
+		for _, d := range devices {
+			if d.Name != name {
+				continue
+			}
+			if d.Fingerprint() != fingerprint {
+				return fmt.Errorf("the fingerprint of device %s in room %s is %s, not %s",
+					name, rc.room.DisplayName(), d.Fingerprint(), fingerprint)
+			}
+			err = rc.pin(true, d)
+			if err != nil {
+				return err
+			}
+			trusted = true
+		}
+	}
+	if !trusted {
+		return fmt.Errorf("unknown device %q", name)
+	}
+	return nil
+}
+
+// Pins calls fn with the devices pinned in each room.
+func (c *Client) Pins(fn func(room *share.Room, devices []*device.Device)) error {
+	if c.identity == nil {
+		return errPairingDisabled
+	}
+	for _, rc := range c.rooms {
+		pins, err := device.Load(rc.pins)
+		if err != nil {
+			return err
+		}
+		fn(rc.room, pins.List())
+	}
+	return nil
+}
+
+// Devices calls fn with the paired devices of each room.
+func (c *Client) Devices(fn func(room *share.Room, devices []*device.Device)) error {
+	if c.identity == nil {
+		return errPairingDisabled
+	}
+	for _, rc := range c.rooms {
+		devices, err := rc.fetchDevices()
+		if err != nil {
+			return fmt.Errorf("failed to list devices in room %s: %v", rc.room.DisplayName(), err)
+		}
+		fn(rc.room, devices)
+	}
+	return nil
+}
+
+// Remove removes the device from the trust store of all the rooms, it
+// cannot connect again until paired again.
+func (c *Client) Remove(name string) error {
+	if c.identity == nil {
+		return errPairingDisabled
+	}
+	query := url.Values{"name": []string{name}}
+	var removed bool
+	for _, rc := range c.rooms {
+		err := rc.call(http.MethodPost, device.PathRemove, query, nil)
+		if errors.Is(err, errNotFound) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to remove device in room %s: %v", rc.room.DisplayName(), err)
+		}
+		removed = true
+	}
+	for _, rc := range c.rooms {
+		pins, err := device.Load(rc.pins)
+		if err != nil {
+			return err
+		}
+		_, err = pins.Remove(name)
+		if err != nil {
+			return err
+		}
+	}
+	if !removed {
+		return fmt.Errorf("unknown device %q", name)
+	}
+	return nil
+}
+
+// pinsFile returns the path of the devices pinned in the room.
+func pinsFile(room string) (string, error) {
+	name := "pins.json"
+	if room != "" {
+		name = "pins-" + url.PathEscape(room) + ".json"
+	}
+	return config.LocalFile(name)
+}
+
+// pin pins the devices, a pinned device with the same name and another
+// key is only replaced if replace is true.
+func (rc *roomConn) pin(replace bool, devices ...*device.Device) error {
+	pins, err := device.Load(rc.pins)
+	if err != nil {
+		return err
+	}
+	for _, d := range devices {
+		err = pins.Add(d, replace)
+		if errors.Is(err, device.ErrExists) {
+			return fmt.Errorf("failed to pin: %v, check the fingerprint and run "+
+				"\"wshared pair trust %s <fingerprint>\" if it is paired again", err, d.Name)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to pin device %s: %v", d.Name, err)
+		}
+	}
+	return nil
+}
+
+func (rc *roomConn) fetchDevices() ([]*device.Device, error) {
+	var devices []*device.Device
+	err := rc.call(http.MethodGet, device.PathList, nil, &devices)
+	return devices, err
+}
+
+func (rc *roomConn) waitApproved(code string) error {
+	header := rc.header.Clone()
+	header.Set(share.HeaderAuthDevice, base64.StdEncoding.EncodeToString(rc.identity.Public))
+	rawURL := rc.httpURL + device.PathStatus + "?" + url.Values{"code": []string{code}}.Encode()
+	for {
+		time.Sleep(pairStatusInterval)
+		req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+		if err != nil {
+			return err
+		}
+		req.Header = header
+		body, err := rc.do(req)
+		if err != nil {
+			return err
+		}
+		switch string(body) {
+		case device.StatusApproved:
+			return nil
+
+		case device.StatusExpired:
+			return errors.New("the code is expired")
+		}
+	}
+}
+
+// call sends an authenticated request to the server API, such as pairing,
+// and decodes the json response to out.
+func (rc *roomConn) call(method, path string, query url.Values, out any) error {
+	rawURL := rc.httpURL + path
+	if len(query) > 0 {
+		rawURL += "?" + query.Encode()
+	}
+	header, err := rc.authHeader(rawURL)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header = header
+	body, err := rc.do(req)
+	if err != nil {
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	err = json.Unmarshal(body, out)
+	if err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+	return nil
+}
+
+func (rc *roomConn) do(req *http.Request) ([]byte, error) {
+	resp, err := rc.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return io.ReadAll(resp.Body)
+
+	case http.StatusUnauthorized:
+		return nil, authError(resp)
+
+	case http.StatusNotFound:
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%w: %s", errNotFound, strings.TrimSpace(string(body)))
+	}
+	body, _ := io.ReadAll(resp.Body)
+	return nil, fmt.Errorf("server returns %s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
@@ -0,0 +1,97 @@
+package client
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/fioncat/wshare/config"
+	"github.com/fioncat/wshare/share"
+)
+
+// The policies of buffering the packets to send while disconnected, see
+// config "offline".
+const (
+	OfflineLatest = "latest"
+	OfflineAll    = "all"
+	OfflineDrop   = "drop"
+)
+
+// maxPending is the max number of packets buffered for a room.
+const maxPending = 500
+
+func loadOfflinePolicies() (map[string]string, error) {
+	policies := config.Get().Offline
+	for name, policy := range policies {
+		switch policy {
+		case OfflineLatest, OfflineAll, OfflineDrop:
+		default:
+			return nil, fmt.Errorf("unknown offline policy %q for %s", policy, name)
+		}
+	}
+	return policies, nil
+}
+
+// pending is the packets to send to a room. Pushing never blocks, so that
+// a room being disconnected does not block the handlers and other rooms.
+type pending struct {
+	policies map[string]string
+
+	// ready is signaled when packets are pushed.
+	ready chan struct{}
+
+	mu    sync.Mutex
+	packs []*share.Packet
+}
+
+func newPending(policies map[string]string) *pending {
+	return &pending{
+		policies: policies,
+		ready:    make(chan struct{}, 1),
+	}
+}
+
+// push adds a packet to send. When not connected, the offline policy of
+// the handler is applied. It returns the number of packets dropped.
+func (p *pending) push(pack *share.Packet, connected bool) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	dropped := 0
+	if !connected {
+		switch p.policies[pack.Type] {
+		case OfflineDrop:
+			return 1
+
+		case OfflineLatest:
+			packs := p.packs[:0]
+			for _, old := range p.packs {
+				if old.Type == pack.Type {
+					dropped++
+					continue
+				}
+				packs = append(packs, old)
+			}
+			p.packs = packs
+		}
+	}
+	if len(p.packs) >= maxPending {
+		p.packs = p.packs[1:]
+		dropped++
+	}
+	p.packs = append(p.packs, pack)
+
+	select {
+	case p.ready <- struct{}{}:
+	default:
+	}
+	return dropped
+}
+
+// pop takes all the packets to send.
+func (p *pending) pop() []*share.Packet {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	packs := p.packs
+	p.packs = nil
+	return packs
+}
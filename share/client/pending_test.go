@@ -0,0 +1,38 @@
+package client
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/fioncat/wshare/share"
+)
+
+func TestPending(t *testing.T) {
+	p := newPending(map[string]string{
+		"clipboard": OfflineLatest,
+		"drop":      OfflineDrop,
+	})
+	for _, data := range []string{"a", "b", "c"} {
+		p.push(&share.Packet{Type: "clipboard", Data: []byte(data)}, false)
+		p.push(&share.Packet{Type: "dir", Data: []byte(data)}, false)
+	}
+	if p.push(&share.Packet{Type: "drop"}, false) != 1 {
+		t.Fatal("expect packet to be dropped")
+	}
+
+	var got []string
+	for _, pack := range p.pop() {
+		got = append(got, pack.Type+":"+string(pack.Data))
+	}
+	expect := "dir:a dir:b clipboard:c dir:c"
+	if s := strings.Join(got, " "); s != expect {
+		t.Fatalf("unexpect pending %q, expect %q", s, expect)
+	}
+
+	// Nothing is dropped when connected.
+	p.push(&share.Packet{Type: "clipboard"}, true)
+	p.push(&share.Packet{Type: "clipboard"}, true)
+	if n := len(p.pop()); n != 2 {
+		t.Fatalf("unexpect pending count %d", n)
+	}
+}
@@ -0,0 +1,36 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/fioncat/wshare/share"
+)
+
+// Presence calls fn with the clients of each room, online and offline.
+func (c *Client) Presence(fn func(room *share.Room, roster []*share.Presence)) error {
+	for _, rc := range c.rooms {
+		var roster []*share.Presence
+		err := rc.call(http.MethodGet, share.PathPresence, nil, &roster)
+		if err != nil {
+			return fmt.Errorf("failed to list clients in room %s: %v", rc.room.DisplayName(), err)
+		}
+		fn(rc.room, roster)
+	}
+	return nil
+}
+
+// updateRoster logs when a client joins or leaves. The server also sends
+// the clients left before after connecting, they are not logged.
+func (rc *roomConn) updateRoster(p *share.Presence) {
+	old := rc.roster[p.ID]
+	rc.roster[p.ID] = p
+	switch {
+	case p.Online && (old == nil || !old.Online || old.Since != p.Since):
+		rc.logger.Infof("%s is online, version %s, handlers: %s", p.Name, p.Version, strings.Join(p.Handlers, ","))
+
+	case !p.Online && old != nil && old.Online:
+		rc.logger.Infof("%s is offline", p.Name)
+	}
+}
@@ -0,0 +1,177 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/fioncat/wshare/config"
+	"github.com/fioncat/wshare/pkg/log"
+	"github.com/fioncat/wshare/share"
+)
+
+// maxDeliveries is the number of the packets sent to keep the status of.
+const maxDeliveries = 20
+
+const deliveriesFile = "deliveries.json"
+
+// Delivery is the status of a packet sent, see share.FrameAck and
+// share.FrameReceipt.
+type Delivery struct {
+	ID   string    `json:"id"`
+	Type string    `json:"type"`
+	Room string    `json:"room,omitempty"`
+	Size int64     `json:"size"`
+	Time time.Time `json:"time"`
+
+	// Acked is true when the server has received the packet, Recipients
+	// is the clients the server delivered it to.
+	Acked      bool     `json:"acked"`
+	Recipients []string `json:"recipients"`
+
+	Receipts map[string]*Receipt `json:"receipts"`
+}
+
+// Receipt is sent by a recipient after handling the packet.
+type Receipt struct {
+	Error string    `json:"error,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// LoadDeliveries returns the status of the packets recently sent by the
+// daemon, the newest first.
+func LoadDeliveries() ([]*Delivery, error) {
+	path, err := config.LocalFile(deliveriesFile)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read deliveries: %v", err)
+	}
+	var deliveries []*Delivery
+	err = json.Unmarshal(data, &deliveries)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode deliveries: %v", err)
+	}
+	return deliveries, nil
+}
+
+// deliveries tracks the packets sent, and saves them for "wshared last".
+// It is nil for the one-shot senders, the methods do nothing then.
+type deliveries struct {
+	path string
+
+	// notify is the command to run for each receipt.
+	notify string
+
+	mu   sync.Mutex
+	list []*Delivery
+}
+
+func newDeliveries() (*deliveries, error) {
+	path, err := config.LocalFile(deliveriesFile)
+	if err != nil {
+		return nil, err
+	}
+	return &deliveries{
+		path:   path,
+		notify: config.Get().Notify,
+	}, nil
+}
+
+func (d *deliveries) add(delivery *Delivery) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.list = append([]*Delivery{delivery}, d.list...)
+	if len(d.list) > maxDeliveries {
+		d.list = d.list[:maxDeliveries]
+	}
+	d.save()
+}
+
+func (d *deliveries) ack(frame *share.Frame) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delivery := d.get(frame.ID)
+	if delivery == nil {
+		return
+	}
+	delivery.Acked = true
+	delivery.Recipients = frame.To
+	d.save()
+}
+
+func (d *deliveries) receipt(frame *share.Frame) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delivery := d.get(frame.ID)
+	if delivery == nil {
+		return
+	}
+	delivery.Receipts[frame.From] = &Receipt{
+		Error: frame.Error,
+		Time:  time.Now(),
+	}
+	d.save()
+	if d.notify != "" {
+		go d.runNotify(delivery, frame)
+	}
+}
+
+func (d *deliveries) get(id string) *Delivery {
+	for _, delivery := range d.list {
+		if delivery.ID == id {
+			return delivery
+		}
+	}
+	return nil
+}
+
+func (d *deliveries) save() {
+	data, err := json.Marshal(d.list)
+	if err != nil {
+		log.Get().Errorf("failed to encode deliveries: %v", err)
+		return
+	}
+	err = os.WriteFile(d.path, data, 0644)
+	if err != nil {
+		log.Get().Errorf("failed to save deliveries: %v", err)
+	}
+}
+
+// runNotify runs the notify command, the receipt is passed by the
+// environment variables.
+func (d *deliveries) runNotify(delivery *Delivery, frame *share.Frame) {
+	status := "ok"
+	if frame.Error != "" {
+		status = "failed"
+	}
+	cmd := exec.Command("sh", "-c", d.notify)
+	cmd.Env = append(os.Environ(),
+		"WSHARE_ID="+delivery.ID,
+		"WSHARE_TYPE="+delivery.Type,
+		"WSHARE_RECIPIENT="+frame.From,
+		"WSHARE_STATUS="+status,
+		"WSHARE_ERROR="+frame.Error,
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		log.Get().Warnf("failed to run notify command: %v, output: %s", err, out)
+	}
+}
@@ -0,0 +1,52 @@
+package client
+
+// connState is the state of the connection to a room:
+//
+//	connecting --> connected --(broken)--> connecting
+//	connecting --(failed)--> backoff --(timeout or reconnect)--> connecting
+//	connecting --(rejected)--> auth-failed --(reconnect)--> connecting
+//	connected --(taken over)--> replaced --(reconnect)--> connecting
+//
+// A reconnect trigger (see Client.Reconnect) also drops a connected
+// connection, and dials again.
+type connState int
+
+const (
+	stateConnecting connState = iota
+	stateConnected
+	stateBackoff
+	stateAuthFailed
+	stateReplaced
+)
+
+func (s connState) String() string {
+	switch s {
+	case stateConnecting:
+		return "connecting"
+	case stateConnected:
+		return "connected"
+	case stateBackoff:
+		return "backoff"
+	case stateAuthFailed:
+		return "auth-failed"
+	case stateReplaced:
+		return "replaced"
+	}
+	return "unknown"
+}
+
+func (rc *roomConn) setState(state connState) {
+	rc.stateMu.Lock()
+	old := rc.state
+	rc.state = state
+	rc.stateMu.Unlock()
+	if old != state {
+		rc.logger.Debugf("connection state: %s -> %s", old, state)
+	}
+}
+
+func (rc *roomConn) connected() bool {
+	rc.stateMu.Lock()
+	defer rc.stateMu.Unlock()
+	return rc.state == stateConnected
+}
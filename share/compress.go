@@ -0,0 +1,81 @@
+package share
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// FlagGzip is set in Frame.Flags when the packet is compressed by gzip,
+// before it is sealed for end-to-end encryption.
+const FlagGzip uint8 = 1 << 0
+
+// compressedTypes is the content types that are already compressed, it
+// is useless to compress them again.
+var compressedTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"application/zip",
+	"application/x-gzip",
+	"application/x-rar-compressed",
+	"application/pdf",
+}
+
+// compress compresses the encoded packet if it is worth it, returns the
+// data and the flags.
+func (p *Packet) compress(data []byte, threshold int) ([]byte, uint8) {
+	if threshold <= 0 || len(data) < threshold {
+		return data, 0
+	}
+	contentType := http.DetectContentType(p.Data)
+	for _, prefix := range compressedTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return data, 0
+		}
+	}
+
+	var buff bytes.Buffer
+	w := gzip.NewWriter(&buff)
+	_, err := w.Write(data)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil || buff.Len() >= len(data) {
+		return data, 0
+	}
+	return buff.Bytes(), FlagGzip
+}
+
+// decompress returns the reader of the packet, the decompressed packet
+// larger than max is rejected, to avoid gzip bombs.
+func decompress(r io.Reader, flags uint8, max int64) (io.Reader, error) {
+	if flags&FlagGzip == 0 {
+		return r, nil
+	}
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress packet: %v", err)
+	}
+	return &limitReader{r: io.LimitReader(gr, max+1), n: max}, nil
+}
+
+// limitReader fails when more than n bytes are read.
+type limitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, errors.New("decompressed packet is too large")
+	}
+	return n, err
+}
@@ -0,0 +1,36 @@
+package share
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestDecompressLimit(t *testing.T) {
+	p := &Packet{Type: "text", Data: bytes.Repeat([]byte("a"), 10000)}
+	data, flags := p.compress(p.marshal(), 1)
+	if flags&FlagGzip == 0 {
+		t.Fatal("expect packet to be compressed")
+	}
+
+	r, err := decompress(bytes.NewReader(data), flags, 20000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(raw, p.marshal()) {
+		t.Fatal("unexpect decompressed packet")
+	}
+
+	r, err = decompress(bytes.NewReader(data), flags, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(r)
+	if err == nil {
+		t.Fatal("expect error for too large packet")
+	}
+}
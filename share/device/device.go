@@ -0,0 +1,184 @@
+package device
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fioncat/wshare/pkg/crypto"
+)
+
+// The paths of the pairing API on the server.
+const (
+	PathRequest = "/pair/request"
+	PathStatus  = "/pair/status"
+	PathPending = "/pair/pending"
+	PathApprove = "/pair/approve"
+	PathList    = "/pair/devices"
+	PathRemove  = "/pair/remove"
+)
+
+// The status of a pairing request.
+const (
+	StatusPending  = "pending"
+	StatusApproved = "approved"
+	StatusExpired  = "expired"
+)
+
+// ErrExists is returned by Store.Add when another device has the name.
+var ErrExists = errors.New("device already exists")
+
+// Request is the response of a pairing request.
+type Request struct {
+	Code string `json:"code"`
+
+	Status string `json:"status"`
+}
+
+// Device is a paired device.
+type Device struct {
+	Name string `json:"name"`
+
+	// Key is the public key of the device.
+	Key []byte `json:"key"`
+
+	// BoxKey is the key to encrypt data to the device, it is signed by
+	// Key, see crypto.VerifyBoxKey. Empty if the device does not send it.
+	BoxKey    []byte `json:"box_key,omitempty"`
+	BoxKeySig []byte `json:"box_key_sig,omitempty"`
+
+	Added time.Time `json:"added"`
+}
+
+func (d *Device) Fingerprint() string {
+	return crypto.Fingerprint(d.Key)
+}
+
+// HasBoxKey reports whether the device has a valid box key.
+func (d *Device) HasBoxKey() bool {
+	return len(d.BoxKey) > 0 && crypto.VerifyBoxKey(d.Key, d.BoxKey, d.BoxKeySig)
+}
+
+// Store is the trust store, it keeps the paired devices in a file.
+type Store struct {
+	mu sync.RWMutex
+
+	path string
+
+	devices map[string]*Device
+}
+
+// Load reads the store from path, an empty store is returned if the file
+// does not exist.
+func Load(path string) (*Store, error) {
+	s := &Store{
+		path:    path,
+		devices: make(map[string]*Device),
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trust store: %v", err)
+	}
+	var devices []*Device
+	err = json.Unmarshal(data, &devices)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse trust store %s: %v", path, err)
+	}
+	for _, d := range devices {
+		s.devices[d.Name] = d
+	}
+	return s, nil
+}
+
+// List returns the devices sorted by name.
+func (s *Store) List() []*Device {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	devices := make([]*Device, 0, len(s.devices))
+	for _, d := range s.devices {
+		devices = append(devices, d)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].Name < devices[j].Name
+	})
+	return devices
+}
+
+func (s *Store) Empty() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.devices) == 0
+}
+
+// Get returns the device with the name and the key, nil if it is not
+// trusted.
+func (s *Store) Get(name string, key []byte) *Device {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	d := s.devices[name]
+	if d == nil || !bytes.Equal(d.Key, key) {
+		return nil
+	}
+	return d
+}
+
+// Has reports whether there is a device with the name.
+func (s *Store) Has(name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.devices[name]
+	return ok
+}
+
+// Add trusts a device. A device with the same name and another key is
+// only replaced if replace is true, such as a reinstalled device paired
+// again, otherwise ErrExists is returned.
+func (s *Store) Add(d *Device, replace bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.devices[d.Name]
+	if old != nil && !bytes.Equal(old.Key, d.Key) && !replace {
+		return fmt.Errorf("%w: %s, fingerprint %s", ErrExists, d.Name, old.Fingerprint())
+	}
+	s.devices[d.Name] = d
+	return s.save()
+}
+
+// Remove removes the device, returns false if it does not exist.
+func (s *Store) Remove(name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.devices[name]; !ok {
+		return false, nil
+	}
+	delete(s.devices, name)
+	return true, s.save()
+}
+
+func (s *Store) save() error {
+	devices := make([]*Device, 0, len(s.devices))
+	for _, d := range s.devices {
+		devices = append(devices, d)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].Name < devices[j].Name
+	})
+	data, err := json.MarshalIndent(devices, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to save trust store: %v", err)
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,216 @@
+package share
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fioncat/wshare/pkg/crypto"
+	"github.com/fioncat/wshare/pkg/log"
+	"github.com/fioncat/wshare/share/device"
+)
+
+const (
+	e2eRefreshInterval = time.Minute
+
+	// e2eMinRefreshInterval limits refreshing for unknown senders.
+	e2eMinRefreshInterval = time.Second * 5
+)
+
+// ErrNoRecipient is returned by Packet.Encode when there is no device to
+// encrypt to.
+var ErrNoRecipient = errors.New("no recipient")
+
+// Replay rejects the sealed packets seen before, or out of the window,
+// see transfer.ReplayWindow.
+type Replay interface {
+	CheckMessage(from string, sent int64, messageID string) error
+}
+
+// Sender is the verified sender of a packet.
+type Sender struct {
+	Name string
+
+	Fingerprint string
+}
+
+// E2E encrypts packets end-to-end: a packet is encrypted to the paired
+// devices and signed by the sender, see crypto.Sealed.
+//
+// The devices are fetched from the trust store on the server, but only
+// the devices whose keys are pinned locally (see the pins store, set when
+// pairing or approving) are used, so the server cannot add or replace a
+// device. The box keys are signed by the device keys.
+type E2E struct {
+	name     string
+	identity *crypto.Identity
+
+	// pins is the path of the pinned devices, it is loaded for each
+	// refresh, since it is changed by the commands.
+	pins string
+
+	fetch func() ([]*device.Device, error)
+
+	// replay checks the sealed packets by the key of the sender, the
+	// frames are stamped by the server, so they are not enough.
+	replay Replay
+
+	mu      sync.Mutex
+	devices map[string]*device.Device
+	fetched time.Time
+
+	// warned is the fingerprints of the unpinned devices warned, by name.
+	warned map[string]string
+}
+
+func NewE2E(name string, identity *crypto.Identity, pins string, fetch func() ([]*device.Device, error), replay Replay) *E2E {
+	return &E2E{
+		name:     name,
+		identity: identity,
+		pins:     pins,
+		fetch:    fetch,
+		replay:   replay,
+		devices:  make(map[string]*device.Device),
+		warned:   make(map[string]string),
+	}
+}
+
+// Refresh fetches the devices from the server.
+func (e *E2E) Refresh() error {
+	devices, err := e.fetch()
+	if err != nil {
+		return fmt.Errorf("failed to fetch devices: %v", err)
+	}
+	pins, err := device.Load(e.pins)
+	if err != nil {
+		return err
+	}
+	m := make(map[string]*device.Device, len(devices))
+	for _, d := range devices {
+		if d.Name == e.name {
+			continue
+		}
+		if pins.Get(d.Name, d.Key) == nil {
+			e.warnUnpinned(d, pins.Has(d.Name))
+			continue
+		}
+		if !d.HasBoxKey() {
+			log.Get().Warnf("device %s does not have a valid box key, cannot encrypt to it", d.Name)
+			continue
+		}
+		m[d.Name] = d
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.devices = m
+	e.fetched = time.Now()
+	return nil
+}
+
+func (e *E2E) warnUnpinned(d *device.Device, changed bool) {
+	fingerprint := d.Fingerprint()
+	e.mu.Lock()
+	warned := e.warned[d.Name] == fingerprint
+	e.warned[d.Name] = fingerprint
+	e.mu.Unlock()
+	if warned {
+		return
+	}
+	if changed {
+		log.Get().Warnf("the key of device %s on the server does not match the pinned key, "+
+			"ignore it. If it is paired again, check the fingerprint %s and run "+
+			"\"wshared pair trust %s %s\"", d.Name, fingerprint, d.Name, fingerprint)
+		return
+	}
+	log.Get().Warnf("device %s is not pinned, ignore it. Check the fingerprint %s and run "+
+		"\"wshared pair trust %s %s\"", d.Name, fingerprint, d.Name, fingerprint)
+}
+
+// get returns the device, the devices are refreshed if they are stale, or
+// if the device is unknown.
+func (e *E2E) get(name string) *device.Device {
+	e.mu.Lock()
+	d := e.devices[name]
+	refresh := time.Since(e.fetched) > e2eRefreshInterval ||
+		(d == nil && time.Since(e.fetched) > e2eMinRefreshInterval)
+	e.mu.Unlock()
+	if !refresh {
+		return d
+	}
+	e.refresh()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.devices[name]
+}
+
+func (e *E2E) list() map[string]*device.Device {
+	e.mu.Lock()
+	refresh := time.Since(e.fetched) > e2eRefreshInterval
+	e.mu.Unlock()
+	if refresh {
+		e.refresh()
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.devices
+}
+
+func (e *E2E) refresh() {
+	err := e.Refresh()
+	if err != nil {
+		log.Get().Warnf("%v, use the cached devices", err)
+	}
+}
+
+// seal encrypts data to the devices in to, or all the other devices if to
+// is empty.
+func (e *E2E) seal(data []byte, to []string) (*crypto.Sealed, error) {
+	recipients := make(map[string][]byte)
+	for name, d := range e.list() {
+		if len(to) > 0 && !contains(to, name) {
+			continue
+		}
+		recipients[name] = d.BoxKey
+	}
+	if len(recipients) == 0 {
+		return nil, ErrNoRecipient
+	}
+	return e.identity.Seal(e.name, data, recipients)
+}
+
+// open verifies the sender with the pinned devices and decrypts the data.
+func (e *E2E) open(s *crypto.Sealed) ([]byte, *Sender, error) {
+	d := e.get(s.Sender)
+	if d == nil {
+		return nil, nil, fmt.Errorf("unknown sender %q", s.Sender)
+	}
+	if !s.Verify(d.Key) {
+		return nil, nil, fmt.Errorf("invalid signature from %q", s.Sender)
+	}
+	fingerprint := d.Fingerprint()
+	err := e.replay.CheckMessage(fingerprint, s.Time, s.MessageID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reject sealed packet from %q: %v", s.Sender, err)
+	}
+	data, err := e.identity.Open(e.name, s)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decrypt data from %q: %v", s.Sender, err)
+	}
+	return data, &Sender{
+		Name:        d.Name,
+		Fingerprint: fingerprint,
+	}, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
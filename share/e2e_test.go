@@ -0,0 +1,123 @@
+package share
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/fioncat/wshare/config"
+	"github.com/fioncat/wshare/pkg/crypto"
+	"github.com/fioncat/wshare/pkg/log"
+	"github.com/fioncat/wshare/share/device"
+)
+
+// testReplay rejects the message ids seen before.
+type testReplay map[string]bool
+
+func (r testReplay) CheckMessage(from string, sent int64, messageID string) error {
+	if r[from+messageID] {
+		return errors.New("replayed")
+	}
+	r[from+messageID] = true
+	return nil
+}
+
+func TestE2EPins(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("WSHARE_CONFIG", filepath.Join(dir, "daemon.yaml"))
+	err := config.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = log.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identities := make(map[string]*crypto.Identity)
+	var devices []*device.Device
+	for _, name := range []string{"a", "b", "c"} {
+		identity, err := crypto.LoadIdentity(filepath.Join(dir, name+".key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		identities[name] = identity
+		devices = append(devices, &device.Device{
+			Name:      name,
+			Key:       identity.Public,
+			BoxKey:    identity.BoxPublic,
+			BoxKeySig: identity.BoxSignature(),
+		})
+	}
+	fetch := func() ([]*device.Device, error) { return devices, nil }
+
+	pinsPath := filepath.Join(dir, "pins.json")
+	pins, err := device.Load(pinsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a only pins b, c is added by the server.
+	err = pins.Add(devices[1], false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewE2E("a", identities["a"], pinsPath, fetch, testReplay{})
+	err = a.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := a.seal([]byte("hello"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sealed.Keys["b"]; !ok || len(sealed.Keys) != 1 {
+		t.Fatal("expect to seal to b only")
+	}
+	_, err = a.seal([]byte("hello"), []string{"c"})
+	if !errors.Is(err, ErrNoRecipient) {
+		t.Fatalf("expect no recipient, got %v", err)
+	}
+
+	// c is not pinned by a, the data from c is rejected.
+	sealed, err = identities["c"].Seal("c", []byte("hello"), map[string][]byte{"a": identities["a"].BoxPublic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = a.open(sealed)
+	if err == nil {
+		t.Fatal("expect error for unpinned sender")
+	}
+
+	// b pins a, and accepts the packet from a only once.
+	bPins := filepath.Join(dir, "pins-b.json")
+	pins, err = device.Load(bPins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pins.Add(devices[0], false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewE2E("b", identities["b"], bPins, fetch, testReplay{})
+	sealed, err = a.seal([]byte("hello"), []string{"b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, sender, err := b.open(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" || sender.Name != "a" {
+		t.Fatalf("unexpected data %q from %v", data, sender)
+	}
+	_, _, err = b.open(sealed)
+	if err == nil {
+		t.Fatal("expect replayed packet to be rejected")
+	}
+	// The time and the message id are signed.
+	sealed.MessageID = "forged"
+	_, _, err = b.open(sealed)
+	if err == nil {
+		t.Fatal("expect forged message id to be rejected")
+	}
+}
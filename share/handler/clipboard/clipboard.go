@@ -42,10 +42,14 @@ func (h *Handler) Notify(ch chan *share.Packet) {
 		if cooldown.Exists(data) {
 			continue
 		}
-		ch <- &share.Packet{
+		pack := &share.Packet{
 			Metadata: []byte(fmtStr),
 			Data:     data,
 		}
+		if fmtStr == "image" {
+			pack.To = config.Get().Clipboard.ImageTargets
+		}
+		ch <- pack
 	}
 }
 
@@ -62,12 +66,12 @@ func (h *Handler) Recv(ctx *share.Context) error {
 	case "image":
 		dataFmt = clipboard.FmtImage
 		cooldown = imageCooldown
-		ctx.History.Write("clipboard-image", "%s size of image", size)
+		ctx.History.Write(historyName(ctx, "clipboard-image"), "%s size of image", size)
 
 	case "text":
 		dataFmt = clipboard.FmtText
 		cooldown = textCooldown
-		ctx.History.Write("clipboard-text", string(pack.Data))
+		ctx.History.Write(historyName(ctx, "clipboard-text"), "%s", pack.Data)
 
 	default:
 		return fmt.Errorf("unknown clipboard fmt %s", fmtStr)
@@ -81,3 +85,12 @@ func (h *Handler) Recv(ctx *share.Context) error {
 
 	return nil
 }
+
+// historyName adds where the clipboard comes from to the history header,
+// such as "clipboard-text from laptop-2 at 10:41".
+func historyName(ctx *share.Context, name string) string {
+	if ctx.Origin == nil || ctx.Origin.Client == "" {
+		return name
+	}
+	return name + " " + ctx.Origin.String()
+}
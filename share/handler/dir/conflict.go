@@ -0,0 +1,262 @@
+package dir
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fioncat/wshare/config"
+	"github.com/fioncat/wshare/pkg/log"
+	"github.com/fioncat/wshare/pkg/manifest"
+	"github.com/fioncat/wshare/pkg/osutil"
+	"github.com/fioncat/wshare/share"
+)
+
+const (
+	conflictKeepBoth = "keep-both"
+	conflictNewest   = "newest"
+	conflictClient   = "client"
+)
+
+// policy decides which side wins in a conflict. The result must be the
+// same on all clients, so that they end up with the same files.
+type policy struct {
+	kind   string
+	winner string
+}
+
+func parsePolicy(s string) (*policy, error) {
+	switch s {
+	case "", conflictKeepBoth:
+		return &policy{kind: conflictKeepBoth}, nil
+
+	case conflictNewest:
+		return &policy{kind: conflictNewest}, nil
+	}
+	prefix := conflictClient + ":"
+	if strings.HasPrefix(s, prefix) && len(s) > len(prefix) {
+		return &policy{kind: conflictClient, winner: s[len(prefix):]}, nil
+	}
+	return nil, fmt.Errorf("unknown conflict policy %q", s)
+}
+
+// side is one of the two changes in a conflict.
+type side struct {
+	client string
+	time   int64
+}
+
+// wins reports whether a wins over b. Ties are broken by client name.
+func (p *policy) wins(a, b side) bool {
+	if p.kind == conflictClient {
+		if a.client == p.winner {
+			return true
+		}
+		if b.client == p.winner {
+			return false
+		}
+	}
+	if a.time != b.time {
+		return a.time > b.time
+	}
+	return a.client > b.client
+}
+
+// conflictName returns the name of the copy for the losing side in the
+// keep-both policy, such as "notes.txt.conflict-laptop-20221101-104100".
+// The time is in UTC so that all clients use the same name.
+func conflictName(name string, s side) string {
+	client := strings.ReplaceAll(s.client, "/", "_")
+	t := time.Unix(0, s.time).UTC().Format("20060102-150405")
+	return fmt.Sprintf("%s.conflict-%s-%s", name, client, t)
+}
+
+// clientName returns our name used in version vectors.
+func clientName() string {
+	name := config.Get().Name
+	if name != "" {
+		return name
+	}
+	name, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return name
+}
+
+// recvWrite writes the file of an add or change, data is the content.
+func (d *syncDir) recvWrite(ctx *share.Context, c *change, data []byte) error {
+	mode := os.FileMode(c.Mode)
+	size := log.BytesSize(data)
+
+	local := d.state.lookup(c.Path)
+	if local != nil && local.Hash != c.Hash {
+		switch c.Version.Compare(local.Version) {
+		case manifest.OrderBefore:
+			ctx.Infof("ignore outdated change for %s from %s", c.Path, c.author(ctx))
+			return nil
+
+		case manifest.OrderConcurrent, manifest.OrderEqual:
+			return d.resolveWrite(ctx, c, local, data, d.policy.kind == conflictKeepBoth)
+		}
+	}
+
+	version := c.Version
+	if local != nil {
+		version = version.Merge(local.Version)
+	}
+	written, err := d.write(c.Path, mode, c.Hash, data, version)
+	if err != nil {
+		return err
+	}
+	if !written {
+		ctx.Infof("%s is up to date", c.Path)
+		return nil
+	}
+	ctx.History.Write("dir-"+d.name, "write %s from %s, %s", c.Path, c.author(ctx), size)
+	ctx.Infof("write %s data to %s", size, c.Path)
+	return nil
+}
+
+// resolveWrite resolves a conflict on the file of c, the winner is decided
+// by the policy. If keepBoth is true, the losing side is saved as a copy.
+func (d *syncDir) resolveWrite(ctx *share.Context, c *change, local *manifest.Entry, data []byte, keepBoth bool) error {
+	mine := side{client: d.state.client, time: local.ModTime}
+	theirs := side{client: c.Origin, time: c.ModTime}
+	merged := local.Version.Merge(c.Version)
+
+	theirsWin := d.policy.wins(theirs, mine)
+	winner, loser := mine, theirs
+	if theirsWin {
+		winner, loser = theirs, mine
+	}
+	ctx.Warnf("conflict on %s between %s and %s, %s wins", c.Path, mine.client, theirs.client, winner.client)
+
+	var copyName string
+	var err error
+	switch {
+	case keepBoth && theirsWin:
+		copyName = conflictName(c.Path, loser)
+		err = d.rename(c.Path, copyName, local.Hash, local.Version)
+		if err == nil {
+			_, err = d.write(c.Path, os.FileMode(c.Mode), c.Hash, data, merged)
+		}
+
+	case keepBoth:
+		copyName = conflictName(c.Path, loser)
+		_, err = d.write(copyName, os.FileMode(c.Mode), c.Hash, data, c.Version)
+		if err == nil {
+			err = d.state.setVersion(c.Path, merged)
+		}
+
+	case theirsWin:
+		_, err = d.write(c.Path, os.FileMode(c.Mode), c.Hash, data, merged)
+
+	default:
+		err = d.state.setVersion(c.Path, merged)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to resolve conflict: %v", err)
+	}
+
+	msg := fmt.Sprintf("conflict on %s between %s and %s, keep %s", c.Path,
+		mine.client, theirs.client, winner.client)
+	if copyName != "" {
+		msg += fmt.Sprintf(", %s saved as %s", loser.client, copyName)
+	}
+	ctx.History.Write("dir-"+d.name, "%s", msg)
+	return nil
+}
+
+func (d *syncDir) recvRemove(ctx *share.Context, c *change) error {
+	local := d.state.lookup(c.Path)
+	if local == nil {
+		return nil
+	}
+	switch c.Version.Compare(local.Version) {
+	case manifest.OrderBefore:
+		ctx.Infof("ignore outdated remove for %s from %s", c.Path, c.author(ctx))
+		return nil
+
+	case manifest.OrderConcurrent, manifest.OrderEqual:
+		// The file was changed here while removed there. For keep-both,
+		// the change is always kept so that nothing is lost.
+		mine := side{client: d.state.client, time: local.ModTime}
+		theirs := side{client: c.Origin, time: c.ModTime}
+		if d.policy.kind == conflictKeepBoth || !d.policy.wins(theirs, mine) {
+			ctx.Warnf("conflict on %s, removed by %s but changed here, keep it", c.Path, c.author(ctx))
+			ctx.History.Write("dir-"+d.name, "conflict on %s between %s and %s, removed by %s, keep %s",
+				c.Path, mine.client, theirs.client, theirs.client, mine.client)
+			return d.state.setVersion(c.Path, local.Version.Merge(c.Version))
+		}
+		ctx.History.Write("dir-"+d.name, "conflict on %s between %s and %s, removed by %s",
+			c.Path, mine.client, theirs.client, theirs.client)
+	}
+
+	err := d.remove(c.Path)
+	if err != nil {
+		return err
+	}
+	ctx.History.Write("dir-"+d.name, "remove %s from %s", c.Path, c.author(ctx))
+	ctx.Infof("remove %s", c.Path)
+	return nil
+}
+
+// recvRename moves a file. The content is taken from the source, so when
+// the target diverged here, it is resolved as a conflict on the target.
+// If the source is missing or changed here, the content is fetched from
+// the sender.
+func (d *syncDir) recvRename(ctx *share.Context, c *change) error {
+	data, ok := d.readSource(c.From, c.Hash)
+	if !ok {
+		if local := d.state.lookup(c.Path); local != nil && local.Hash == c.Hash {
+			// Already moved.
+			return nil
+		}
+		return d.fetch(ctx, c)
+	}
+
+	local := d.state.lookup(c.Path)
+	if local != nil && local.Hash != c.Hash {
+		// The versions are of different files, and the source is removed
+		// after, so the losing side is always kept as a copy whatever the
+		// policy, otherwise the moved content is lost.
+		err := d.resolveWrite(ctx, c, local, data, true)
+		if err != nil {
+			return err
+		}
+		err = d.remove(c.From)
+		if err != nil {
+			return err
+		}
+		ctx.History.Write("dir-"+d.name, "remove %s moved by %s", c.From, c.author(ctx))
+		return nil
+	}
+
+	err := d.rename(c.From, c.Path, c.Hash, c.Version)
+	if err != nil {
+		return err
+	}
+	ctx.History.Write("dir-"+d.name, "move %s to %s, from %s", c.From, c.Path, c.author(ctx))
+	ctx.Infof("move %s to %s", c.From, c.Path)
+	return nil
+}
+
+// readSource returns the content of the source of a rename, false if it is
+// missing or has changed.
+func (d *syncDir) readSource(name, hash string) ([]byte, bool) {
+	local := d.state.lookup(name)
+	if local == nil || local.Hash != hash {
+		return nil, false
+	}
+	path, err := d.localPath(name)
+	if err != nil {
+		return nil, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || osutil.Sum(data) != hash {
+		return nil, false
+	}
+	return data, true
+}
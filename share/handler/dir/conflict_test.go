@@ -0,0 +1,258 @@
+package dir
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fioncat/wshare/config"
+	"github.com/fioncat/wshare/pkg/log"
+	"github.com/fioncat/wshare/pkg/manifest"
+	"github.com/fioncat/wshare/pkg/osutil"
+	"github.com/fioncat/wshare/share"
+)
+
+var testDirs int
+
+// newTestDir returns a dir with the file "f" written by us, whose name is
+// "me" in version vectors.
+func newTestDir(t *testing.T, conflict string) (*syncDir, *share.Context, *manifest.Entry) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("WSHARE_CONFIG", filepath.Join(home, "daemon.yaml"))
+	err := config.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = log.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	history, err := share.OpenHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &share.Context{
+		Entry:   log.Get().WithField("test", t.Name()),
+		History: history,
+		Origin:  &share.Origin{Client: "peer"},
+	}
+
+	p, err := parsePolicy(conflict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The config is only initialized once, use a new name so that the
+	// manifest is not shared.
+	testDirs++
+	d := &syncDir{
+		name:   fmt.Sprintf("test-%d", testDirs),
+		root:   t.TempDir(),
+		policy: p,
+	}
+	err = d.loadIgnore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.state, err = loadState(d.name, d.root, d.skip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.state.client = "me"
+
+	err = os.WriteFile(filepath.Join(d.root, "f"), []byte("mine"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.state.refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, ctx, d.state.lookup("f")
+}
+
+// files returns the content of the files in the dir.
+func (d *syncDir) files(t *testing.T) map[string]string {
+	entries, err := os.ReadDir(d.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(d.root, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[entry.Name()] = string(data)
+	}
+	return files
+}
+
+func TestPolicyWins(t *testing.T) {
+	older := side{client: "a", time: 1}
+	newer := side{client: "b", time: 2}
+	for _, c := range []struct {
+		policy string
+		a, b   side
+		want   bool
+	}{
+		{policy: conflictNewest, a: newer, b: older, want: true},
+		{policy: conflictNewest, a: older, b: newer, want: false},
+		// Ties are broken by client name.
+		{policy: conflictNewest, a: side{client: "b", time: 1}, b: older, want: true},
+		{policy: conflictKeepBoth, a: newer, b: older, want: true},
+		{policy: "client:a", a: older, b: newer, want: true},
+		{policy: "client:a", a: newer, b: older, want: false},
+		// The winner is not in the conflict, fallback to newest.
+		{policy: "client:c", a: newer, b: older, want: true},
+	} {
+		p, err := parsePolicy(c.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.wins(c.a, c.b); got != c.want {
+			t.Fatalf("%s: expect %v wins over %v to be %v", c.policy, c.a, c.b, c.want)
+		}
+	}
+	_, err := parsePolicy("client:")
+	if err == nil {
+		t.Fatal("expect error for client policy without name")
+	}
+}
+
+func TestRecvWrite(t *testing.T) {
+	concurrent := manifest.Version{"peer": 1}
+	for _, c := range []struct {
+		name    string
+		policy  string
+		version manifest.Version
+		// newer is whether their change is made after ours.
+		newer bool
+		// copied is who is saved as a conflict copy, empty for none.
+		copied string
+		want   string
+	}{
+		{name: "keep both, theirs win", policy: conflictKeepBoth, version: concurrent, newer: true, copied: "me", want: "theirs"},
+		{name: "keep both, mine win", policy: conflictKeepBoth, version: concurrent, copied: "peer", want: "mine"},
+		{name: "newest, theirs win", policy: conflictNewest, version: concurrent, newer: true, want: "theirs"},
+		{name: "newest, mine win", policy: conflictNewest, version: concurrent, want: "mine"},
+		{name: "client, theirs win", policy: "client:peer", version: concurrent, want: "theirs"},
+		{name: "client, mine win", policy: "client:me", version: concurrent, newer: true, want: "mine"},
+		{name: "outdated", policy: conflictKeepBoth, version: manifest.Version{}, newer: true, want: "mine"},
+		{name: "after", policy: conflictKeepBoth, version: manifest.Version{"me": 1, "peer": 1}, want: "theirs"},
+	} {
+		d, ctx, local := newTestDir(t, c.policy)
+		theirs := side{client: "peer", time: local.ModTime - int64(time.Hour)}
+		if c.newer {
+			theirs.time = local.ModTime + int64(time.Hour)
+		}
+		data := []byte("theirs")
+		err := d.recvWrite(ctx, &change{
+			Dir:     d.name,
+			Op:      manifest.OpChange,
+			Path:    "f",
+			Mode:    0644,
+			Hash:    osutil.Sum(data),
+			Version: c.version,
+			Origin:  theirs.client,
+			ModTime: theirs.time,
+		}, data)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+
+		want := map[string]string{"f": c.want}
+		switch c.copied {
+		case "me":
+			want[conflictName("f", side{client: "me", time: local.ModTime})] = "mine"
+		case "peer":
+			want[conflictName("f", theirs)] = "theirs"
+		}
+		if got := d.files(t); !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: expect %v, got %v", c.name, want, got)
+		}
+		// Both sides are known after resolving.
+		if c.version.Compare(d.state.lookup("f").Version) == manifest.OrderAfter {
+			t.Fatalf("%s: expect version to include theirs", c.name)
+		}
+	}
+}
+
+func TestRecvRename(t *testing.T) {
+	data := []byte("mine")
+	moved := &change{
+		Op:      manifest.OpRename,
+		From:    "f",
+		Path:    "g",
+		Mode:    0644,
+		Hash:    osutil.Sum(data),
+		Version: manifest.Version{"me": 1, "peer": 1},
+		Origin:  "peer",
+		ModTime: time.Now().Add(time.Hour).UnixNano(),
+	}
+
+	// The target diverged here, both sides are kept whatever the policy.
+	for _, c := range []struct {
+		policy string
+		// moved is whether the moved file wins.
+		moved bool
+	}{
+		{policy: conflictKeepBoth, moved: true},
+		{policy: conflictNewest, moved: true},
+		{policy: "client:me"},
+	} {
+		d, ctx, _ := newTestDir(t, c.policy)
+		err := os.WriteFile(filepath.Join(d.root, "g"), []byte("other"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = d.state.refresh()
+		if err != nil {
+			t.Fatal(err)
+		}
+		target := d.state.lookup("g")
+		err = d.recvRename(ctx, moved)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]string{
+			"g": "mine",
+			conflictName("g", side{client: "me", time: target.ModTime}): "other",
+		}
+		if !c.moved {
+			want = map[string]string{
+				"g": "other",
+				conflictName("g", side{client: "peer", time: moved.ModTime}): "mine",
+			}
+		}
+		if got := d.files(t); !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: expect %v, got %v", c.policy, want, got)
+		}
+	}
+
+	// The source changed here, the content is fetched from the sender.
+	d, ctx, _ := newTestDir(t, conflictKeepBoth)
+	d.out = make(chan *share.Packet, 1)
+	err := os.WriteFile(filepath.Join(d.root, "f"), []byte("changed"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.recvRename(ctx, moved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case pack := <-d.out:
+		if !reflect.DeepEqual(pack.To, []string{"peer"}) {
+			t.Fatalf("expect fetch from peer, got %v", pack.To)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect fetch request")
+	}
+	if got := d.files(t); !reflect.DeepEqual(got, map[string]string{"f": "changed"}) {
+		t.Fatalf("expect files not moved, got %v", got)
+	}
+}
@@ -0,0 +1,418 @@
+package dir
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fioncat/wshare/config"
+	"github.com/fioncat/wshare/pkg/ignore"
+	"github.com/fioncat/wshare/pkg/log"
+	"github.com/fioncat/wshare/pkg/manifest"
+	"github.com/fioncat/wshare/pkg/osutil"
+	"github.com/fioncat/wshare/pkg/watchdir"
+	"github.com/fioncat/wshare/share"
+	"github.com/sirupsen/logrus"
+)
+
+const tempPrefix = ".wshare-"
+
+// change is the metadata of a directory packet. Only deltas are sent: the
+// file content is carried in the packet data for add and change, rename
+// and remove have no data.
+type change struct {
+	Dir  string      `json:"dir"`
+	Op   manifest.Op `json:"op"`
+	Path string      `json:"path"`
+	From string      `json:"from,omitempty"`
+	Mode uint32      `json:"mode,omitempty"`
+	Hash string      `json:"hash,omitempty"`
+
+	// Version is the version vector of the file after the change, Origin
+	// and ModTime tell who made the change and when. They are used to
+	// detect and resolve conflicts.
+	Version manifest.Version `json:"version"`
+	Origin  string           `json:"origin"`
+	ModTime int64            `json:"mtime"`
+}
+
+// author returns who made the change, for logs and history. The client
+// stamped by the server is preferred, Origin is only claimed by the sender
+// and is kept for the version vectors.
+func (c *change) author(ctx *share.Context) string {
+	if ctx.Origin != nil && ctx.Origin.Client != "" {
+		return ctx.Origin.Client
+	}
+	return c.Origin
+}
+
+type Handler struct {
+	dirs map[string]*syncDir
+}
+
+func New() (share.Handler, error) {
+	cfgs := config.Get().Dirs
+	dirs := make(map[string]*syncDir, len(cfgs))
+	for _, cfg := range cfgs {
+		if _, ok := dirs[cfg.Name]; ok {
+			return nil, fmt.Errorf("duplicate dir name %q", cfg.Name)
+		}
+		d, err := newSyncDir(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init dir %q: %v", cfg.Name, err)
+		}
+		dirs[cfg.Name] = d
+	}
+	return &Handler{dirs: dirs}, nil
+}
+
+func (h *Handler) Notify(ch chan *share.Packet) {
+	for _, d := range h.dirs {
+		go d.watch(ch)
+	}
+	select {}
+}
+
+func (h *Handler) Recv(ctx *share.Context) error {
+	var c change
+	err := json.Unmarshal(ctx.Pack.Metadata, &c)
+	if err != nil {
+		return fmt.Errorf("failed to decode dir metadata: %v", err)
+	}
+	d := h.dirs[c.Dir]
+	if d == nil {
+		ctx.Warnf("recv change for unknown dir %q, discarded it", c.Dir)
+		return nil
+	}
+	if c.Op == opIndex {
+		return d.recvIndex(ctx)
+	}
+	if d.skip(c.Path, false) || (c.From != "" && d.skip(c.From, false)) {
+		ctx.Infof("%s is ignored, discarded it", c.Path)
+		return nil
+	}
+
+	switch c.Op {
+	case manifest.OpAdd, manifest.OpChange:
+		if osutil.Sum(ctx.Pack.Data) != c.Hash {
+			return fmt.Errorf("hash mismatch for %s", c.Path)
+		}
+		return d.recvWrite(ctx, &c, ctx.Pack.Data)
+
+	case manifest.OpRename:
+		return d.recvRename(ctx, &c)
+
+	case manifest.OpRemove:
+		return d.recvRemove(ctx, &c)
+
+	case opFetch:
+		return d.recvFetch(ctx, &c)
+
+	default:
+		return fmt.Errorf("unknown dir op %q", c.Op)
+	}
+}
+
+type syncDir struct {
+	name string
+	root string
+
+	policy *policy
+
+	patterns []string
+	ignoreMu sync.RWMutex
+	ignore   *ignore.Matcher
+
+	notify *watchdir.Notify
+
+	// out is the channel to send packets, set when watching starts.
+	outMu sync.Mutex
+	out   chan *share.Packet
+
+	state *state
+}
+
+func newSyncDir(cfg *config.Dir) (*syncDir, error) {
+	root := os.ExpandEnv(cfg.Path)
+	if strings.HasPrefix(root, "~/") {
+		root = filepath.Join(config.HomeDir(), root[2:])
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	p, err := parsePolicy(cfg.Conflict)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(root, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &syncDir{
+		name:     cfg.Name,
+		root:     root,
+		policy:   p,
+		patterns: cfg.Ignore,
+	}
+	err = d.loadIgnore()
+	if err != nil {
+		return nil, err
+	}
+
+	d.state, err = loadState(cfg.Name, root, d.skip)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load state: %v", err)
+	}
+
+	d.notify, err = watchdir.NewNotify(root, true, d.skip)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// loadIgnore (re)loads the ignore patterns from config and the ignore
+// file in the root.
+func (d *syncDir) loadIgnore() error {
+	m, err := ignore.Load(d.root, d.patterns)
+	if err != nil {
+		return err
+	}
+	d.ignoreMu.Lock()
+	d.ignore = m
+	d.ignoreMu.Unlock()
+	return nil
+}
+
+// skip reports whether a path should not be synced. It is applied to
+// watching, manifest building and incoming changes.
+func (d *syncDir) skip(name string, dir bool) bool {
+	if strings.HasPrefix(path.Base(name), tempPrefix) {
+		return true
+	}
+	d.ignoreMu.RLock()
+	defer d.ignoreMu.RUnlock()
+	return d.ignore.Match(name, dir)
+}
+
+func (d *syncDir) watch(ch chan *share.Packet) {
+	d.outMu.Lock()
+	d.out = ch
+	d.outMu.Unlock()
+	logger := log.Get().WithField("dir", d.name)
+	// Send the changes made while we were not running first, then ask
+	// the peers for the files we miss.
+	d.sync(ch, logger)
+	index, err := d.index()
+	if err != nil {
+		logger.Errorf("failed to build index: %v", err)
+	} else {
+		ch <- index
+	}
+	for range d.notify.C {
+		d.sync(ch, logger)
+	}
+}
+
+func (d *syncDir) sync(ch chan *share.Packet, logger *logrus.Entry) {
+	err := d.loadIgnore()
+	if err != nil {
+		logger.Errorf("failed to load ignore patterns: %v", err)
+	}
+	changes, err := d.state.refresh()
+	if err != nil {
+		logger.Errorf("failed to scan dir: %v", err)
+		return
+	}
+	for _, c := range changes {
+		pack, err := d.pack(c)
+		if err != nil {
+			logger.Errorf("failed to pack %s: %v", c.Path(), err)
+			continue
+		}
+		ch <- pack
+	}
+}
+
+func (d *syncDir) pack(mc *manifest.Change) (*share.Packet, error) {
+	c := &change{
+		Dir:     d.name,
+		Op:      mc.Op,
+		Path:    mc.Path(),
+		From:    mc.From,
+		Mode:    uint32(mc.Entry.Mode),
+		Hash:    mc.Entry.Hash,
+		Version: mc.Entry.Version,
+		Origin:  d.state.client,
+		ModTime: mc.Entry.ModTime,
+	}
+	if c.Op == manifest.OpRemove {
+		c.ModTime = time.Now().UnixNano()
+	}
+	var data []byte
+	if c.Op == manifest.OpAdd || c.Op == manifest.OpChange {
+		path, err := d.localPath(c.Path)
+		if err != nil {
+			return nil, err
+		}
+		data, err = os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if osutil.Sum(data) != c.Hash {
+			// The file was modified after scanning, the next scan will
+			// send it again.
+			return nil, errors.New("file changed during packing")
+		}
+	}
+	meta, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	return &share.Packet{
+		Metadata: meta,
+		Data:     data,
+	}, nil
+}
+
+// localPath converts a slash separated path relative to the root into a
+// local path. It refuses paths that escape from the root, by ".." or by
+// symlinks, and symlinks themselves, so that peers cannot touch the files
+// out of the root.
+func (d *syncDir) localPath(name string) (string, error) {
+	path := filepath.Join(d.root, filepath.FromSlash(name))
+	if !strings.HasPrefix(path, d.root+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid path %q", name)
+	}
+
+	// The dirs missing are created by us later, check the nearest one
+	// existing.
+	root, err := filepath.EvalSymlinks(d.root)
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Dir(path)
+	for {
+		real, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			if real != root && !strings.HasPrefix(real, root+string(filepath.Separator)) {
+				return "", fmt.Errorf("path %q is out of the root through a symlink", name)
+			}
+			break
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+		dir = filepath.Dir(dir)
+	}
+	info, err := os.Lstat(path)
+	if err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return "", fmt.Errorf("path %q is a symlink", name)
+	}
+	return path, nil
+}
+
+// write writes data to a file and records its version. If the local file
+// already has the same content, nothing is written and false is returned.
+func (d *syncDir) write(name string, mode os.FileMode, hash string, data []byte, version manifest.Version) (bool, error) {
+	path, err := d.localPath(name)
+	if err != nil {
+		return false, err
+	}
+	if mode == 0 {
+		mode = 0644
+	}
+	e := d.state.lookup(name)
+	if e != nil && e.Hash == hash && e.Mode == mode.Perm() {
+		return false, d.state.setVersion(name, version)
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return false, fmt.Errorf("failed to ensure dir: %v", err)
+	}
+
+	// Write to a temp file and rename it, so that the watcher never sees
+	// a half-written file.
+	tmp, err := os.CreateTemp(filepath.Dir(path), tempPrefix+"*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(mode.Perm())
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to write temp file: %v", err)
+	}
+
+	d.state.mu.Lock()
+	defer d.state.mu.Unlock()
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return false, err
+	}
+	return true, d.state.update(name, version)
+}
+
+func (d *syncDir) rename(from, to, hash string, version manifest.Version) error {
+	fromPath, err := d.localPath(from)
+	if err != nil {
+		return err
+	}
+	toPath, err := d.localPath(to)
+	if err != nil {
+		return err
+	}
+
+	d.state.mu.Lock()
+	defer d.state.mu.Unlock()
+	e := d.state.get(from)
+	if e == nil || e.Hash != hash {
+		if cur := d.state.get(to); cur != nil && cur.Hash == hash {
+			// Already moved.
+			return nil
+		}
+		return fmt.Errorf("cannot move %s to %s, the source is missing or changed", from, to)
+	}
+	err = os.MkdirAll(filepath.Dir(toPath), os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("failed to ensure dir: %v", err)
+	}
+	err = os.Rename(fromPath, toPath)
+	if err != nil {
+		return err
+	}
+	err = d.state.delete(from)
+	if err != nil {
+		return err
+	}
+	return d.state.update(to, version)
+}
+
+func (d *syncDir) remove(name string) error {
+	path, err := d.localPath(name)
+	if err != nil {
+		return err
+	}
+
+	d.state.mu.Lock()
+	defer d.state.mu.Unlock()
+	err = os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return d.state.delete(name)
+}
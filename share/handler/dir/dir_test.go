@@ -0,0 +1,99 @@
+package dir
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fioncat/wshare/pkg/manifest"
+	"github.com/fioncat/wshare/share"
+)
+
+func TestLocalPath(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	err := os.Mkdir(filepath.Join(root, "sub"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(outside, filepath.Join(root, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(filepath.Join(outside, "f"), filepath.Join(root, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &syncDir{root: root}
+	for _, c := range []struct {
+		name string
+		ok   bool
+	}{
+		{name: "f", ok: true},
+		{name: "sub/f", ok: true},
+		{name: "new/dir/f", ok: true},
+		{name: "../f"},
+		{name: "out/f"},
+		{name: "out/new/f"},
+		{name: "link"},
+	} {
+		_, err := d.localPath(c.name)
+		if (err == nil) != c.ok {
+			t.Fatalf("%s: expect ok %v, got %v", c.name, c.ok, err)
+		}
+	}
+}
+
+func TestRecvIndex(t *testing.T) {
+	d, ctx, local := newTestDir(t, conflictKeepBoth)
+	err := os.WriteFile(filepath.Join(d.root, "g"), []byte("known"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.state.refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.out = make(chan *share.Packet, 2)
+
+	// The peer has g and a newer h, f is missed.
+	g := d.state.lookup("g")
+	index, err := json.Marshal([]*indexEntry{
+		{Path: "g", Hash: g.Hash, Version: g.Version},
+		{Path: "h", Hash: "x", Version: manifest.Version{"peer": 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.Pack = &share.Packet{Data: index}
+	err = d.recvIndex(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case pack := <-d.out:
+		if !reflect.DeepEqual(pack.To, []string{"peer"}) {
+			t.Fatalf("expect file sent to peer, got %v", pack.To)
+		}
+		var c change
+		err = json.Unmarshal(pack.Metadata, &c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Op != manifest.OpAdd || c.Path != "f" || c.Hash != local.Hash {
+			t.Fatalf("expect f to be added, got %+v", c)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect f to be sent")
+	}
+	select {
+	case pack := <-d.out:
+		t.Fatalf("expect only f to be sent, got %s", pack.Metadata)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
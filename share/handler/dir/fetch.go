@@ -0,0 +1,68 @@
+package dir
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/fioncat/wshare/pkg/manifest"
+	"github.com/fioncat/wshare/share"
+)
+
+// opFetch asks the sender of a rename for the content of the file, when
+// the source of the rename is missing or has changed here.
+const opFetch manifest.Op = "fetch"
+
+// fetch asks the sender of c for the content of the target.
+func (d *syncDir) fetch(ctx *share.Context, c *change) error {
+	if ctx.Origin == nil || ctx.Origin.Client == "" {
+		return fmt.Errorf("cannot move %s to %s, the source is missing or changed, "+
+			"and the sender does not have a name to fetch it from", c.From, c.Path)
+	}
+	req := &change{
+		Dir:  d.name,
+		Op:   opFetch,
+		Path: c.Path,
+		Hash: c.Hash,
+	}
+	meta, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	ctx.Infof("source %s is missing or changed, fetch %s from %s", c.From, c.Path, ctx.Origin.Client)
+	d.send(&share.Packet{Metadata: meta, To: []string{ctx.Origin.Client}})
+	return nil
+}
+
+// recvFetch sends the file requested by fetch, if it is not changed.
+func (d *syncDir) recvFetch(ctx *share.Context, c *change) error {
+	if ctx.Origin == nil || ctx.Origin.Client == "" {
+		return nil
+	}
+	local := d.state.lookup(c.Path)
+	if local == nil || local.Hash != c.Hash {
+		// It is changed or removed since, the change is sent anyway.
+		ctx.Infof("%s requested by %s is changed, skip it", c.Path, ctx.Origin.Client)
+		return nil
+	}
+	entry := *local
+	pack, err := d.pack(&manifest.Change{Op: manifest.OpChange, Entry: &entry})
+	if err != nil {
+		return fmt.Errorf("failed to pack %s: %v", c.Path, err)
+	}
+	pack.To = []string{ctx.Origin.Client}
+	ctx.Infof("send %s requested by %s", c.Path, ctx.Origin.Client)
+	d.send(pack)
+	return nil
+}
+
+// send sends a packet out of the watching loop. It does not block, the
+// channel is drained by the client that is delivering to us.
+func (d *syncDir) send(pack *share.Packet) {
+	d.outMu.Lock()
+	out := d.out
+	d.outMu.Unlock()
+	if out == nil {
+		return
+	}
+	go func() { out <- pack }()
+}
@@ -0,0 +1,102 @@
+package dir
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/fioncat/wshare/pkg/manifest"
+	"github.com/fioncat/wshare/share"
+)
+
+// opIndex is sent when watching starts, with the files we have. The peers
+// reply the files we do not have, or have older versions of, so that a
+// client joining gets the files existing before. Only deltas are sent
+// after that.
+const opIndex manifest.Op = "index"
+
+// indexEntry is a file in the index.
+type indexEntry struct {
+	Path    string           `json:"path"`
+	Hash    string           `json:"hash"`
+	Version manifest.Version `json:"version,omitempty"`
+}
+
+// index returns the packet of the index, the entries are in the data.
+func (d *syncDir) index() (*share.Packet, error) {
+	entries := d.state.entries()
+	index := make([]*indexEntry, len(entries))
+	for i, e := range entries {
+		index[i] = &indexEntry{Path: e.Path, Hash: e.Hash, Version: e.Version}
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := json.Marshal(&change{Dir: d.name, Op: opIndex})
+	if err != nil {
+		return nil, err
+	}
+	return &share.Packet{Metadata: meta, Data: data}, nil
+}
+
+// recvIndex sends the files the sender of the index needs. The files we
+// do not have are not removed there: without tombstones, we cannot tell
+// whether they are removed here or never synced.
+func (d *syncDir) recvIndex(ctx *share.Context) error {
+	if ctx.Origin == nil || ctx.Origin.Client == "" {
+		return nil
+	}
+	var index []*indexEntry
+	err := json.Unmarshal(ctx.Pack.Data, &index)
+	if err != nil {
+		return fmt.Errorf("failed to decode index: %v", err)
+	}
+	theirs := make(map[string]*indexEntry, len(index))
+	for _, e := range index {
+		theirs[e.Path] = e
+	}
+
+	var changes []*manifest.Change
+	for _, local := range d.state.entries() {
+		if d.skip(local.Path, false) {
+			continue
+		}
+		op := manifest.OpAdd
+		if e := theirs[local.Path]; e != nil {
+			if e.Hash == local.Hash {
+				continue
+			}
+			switch local.Version.Compare(e.Version) {
+			case manifest.OrderBefore, manifest.OrderEqual:
+				continue
+			}
+			op = manifest.OpChange
+		}
+		changes = append(changes, &manifest.Change{Op: op, Entry: local})
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+
+	to := ctx.Origin.Client
+	ctx.Infof("send %d files missed by %s", len(changes), to)
+	d.outMu.Lock()
+	out := d.out
+	d.outMu.Unlock()
+	if out == nil {
+		return nil
+	}
+	// The files are read one by one, and not to block receiving.
+	go func() {
+		for _, c := range changes {
+			pack, err := d.pack(c)
+			if err != nil {
+				ctx.Warnf("failed to pack %s: %v", c.Path(), err)
+				continue
+			}
+			pack.To = []string{to}
+			out <- pack
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,143 @@
+package dir
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/fioncat/wshare/config"
+	"github.com/fioncat/wshare/pkg/manifest"
+)
+
+// state holds the manifest of a synced directory, it is used to find out
+// what changed since the last scan. The manifest is persisted, so changes
+// made while the daemon is not running are sent after it starts.
+type state struct {
+	mu sync.Mutex
+
+	root string
+	path string
+
+	// client is our name in version vectors.
+	client string
+
+	filter manifest.Filter
+
+	manifest *manifest.Manifest
+}
+
+func loadState(name, root string, filter manifest.Filter) (*state, error) {
+	path, err := config.LocalFile(fmt.Sprintf("dir-%s.manifest", name))
+	if err != nil {
+		return nil, err
+	}
+	m, err := manifest.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	return &state{
+		root:     root,
+		path:     path,
+		client:   clientName(),
+		filter:   filter,
+		manifest: m,
+	}, nil
+}
+
+// refresh scans the root again and returns changes since the last scan.
+func (s *state) refresh() ([]*manifest.Change, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, err := manifest.Build(s.root, s.manifest, s.filter)
+	if err != nil {
+		return nil, err
+	}
+	for name := range s.manifest.Files {
+		// The files ignored after last scan are not removed, so don't
+		// tell others to remove them.
+		if _, ok := m.Files[name]; !ok && s.filter(name, false) {
+			delete(s.manifest.Files, name)
+		}
+	}
+	changes := manifest.Diff(s.manifest, m)
+	for _, c := range changes {
+		switch c.Op {
+		case manifest.OpRename:
+			from := s.manifest.Files[c.From]
+			c.Entry.Version = from.Version.Bump(s.client)
+
+		default:
+			c.Entry.Version = c.Entry.Version.Bump(s.client)
+		}
+	}
+	s.manifest = m
+	if len(changes) == 0 {
+		return nil, nil
+	}
+	return changes, s.save()
+}
+
+// get returns the entry of a file, the caller must hold the lock.
+func (s *state) get(name string) *manifest.Entry {
+	return s.manifest.Files[name]
+}
+
+func (s *state) lookup(name string) *manifest.Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.get(name)
+}
+
+// entries returns the entries of all the files, sorted by path.
+func (s *state) entries() []*manifest.Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := make([]*manifest.Entry, 0, len(s.manifest.Files))
+	for _, e := range s.manifest.Files {
+		copied := *e
+		entries = append(entries, &copied)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+	return entries
+}
+
+// update records the current state and version of a file written by us,
+// so that the next refresh won't send it back. The caller must hold the
+// lock.
+func (s *state) update(name string, version manifest.Version) error {
+	e, err := manifest.Stat(s.root, name)
+	if err != nil {
+		return err
+	}
+	e.Version = version
+	s.manifest.Files[name] = e
+	return s.save()
+}
+
+func (s *state) setVersion(name string, version manifest.Version) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.manifest.Files[name]
+	if e == nil {
+		return nil
+	}
+	e.Version = version
+	return s.save()
+}
+
+// delete is the same as update, but for removed files.
+func (s *state) delete(name string) error {
+	delete(s.manifest.Files, name)
+	return s.save()
+}
+
+func (s *state) save() error {
+	err := s.manifest.Save(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to save manifest: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package share
+
+import (
+	"fmt"
+	"time"
+)
+
+// Origin tells where a packet comes from. It is stamped by the server when
+// relaying, so unlike Sender it is not verified by the receiver, but it is
+// available without end-to-end encryption.
+type Origin struct {
+	// Client is the name of the sending client on the server.
+	Client string
+
+	// Time is when the client sent the packet, by the clock of the client.
+	Time time.Time
+
+	// MessageID is the transfer ID of the packet, the same as in the
+	// delivery status of the sender, see "wshared last".
+	MessageID string
+
+	// Hops is the servers the packet went through.
+	Hops []Hop
+}
+
+// Hop is a server relaying a frame.
+type Hop struct {
+	Name string
+
+	// Time (unix nanoseconds) is when the server received the frame.
+	Time int64
+}
+
+func (o *Origin) String() string {
+	return fmt.Sprintf("from %s at %s", o.Client, o.Time.Format("15:04"))
+}
+
+// Stamp is called by the server before relaying a frame. From is set to the
+// name of the client on the server, so that the clients cannot pretend to
+// be others, and the server is added to Hops. The original time of the
+// frame is kept in Sent, since Encode stamps a new time.
+func (f *Frame) Stamp(from, server string) {
+	f.From = from
+	if f.Sent == 0 {
+		f.Sent = f.Time
+	}
+	f.Hops = append(f.Hops, Hop{
+		Name: server,
+		Time: time.Now().UnixNano(),
+	})
+}
+
+// Origin returns the origin of the transfer, from its last frame.
+func (f *Frame) Origin() *Origin {
+	sent := f.Sent
+	if sent == 0 {
+		sent = f.Time
+	}
+	return &Origin{
+		Client:    f.From,
+		Time:      time.Unix(0, sent),
+		MessageID: f.ID,
+		Hops:      f.Hops,
+	}
+}
@@ -0,0 +1,45 @@
+package share
+
+import (
+	"testing"
+
+	"github.com/fioncat/wshare/pkg/crypto"
+)
+
+func TestStamp(t *testing.T) {
+	key, err := crypto.NewKey("test12345", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := &Frame{Kind: FrameChunk, ID: "t1", Total: 1, Data: []byte("hello")}
+	frame.From = "someone-else"
+	data, err := frame.Encode(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := frame.Time
+
+	for _, server := range []string{"s1", "s2"} {
+		frame, err = DecodeFrame(key, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame.Stamp("laptop", server)
+		data, err = frame.Encode(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	frame, err = DecodeFrame(key, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	origin := frame.Origin()
+	if origin.Client != "laptop" || origin.MessageID != "t1" || origin.Time.UnixNano() != sent {
+		t.Fatalf("unexpect origin %+v", origin)
+	}
+	if len(origin.Hops) != 2 || origin.Hops[0].Name != "s1" || origin.Hops[1].Name != "s2" {
+		t.Fatalf("unexpect hops %+v", origin.Hops)
+	}
+}
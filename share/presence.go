@@ -0,0 +1,138 @@
+package share
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	"github.com/fioncat/wshare/pkg/wire"
+)
+
+// PathPresence lists the clients of the room, online and offline, it is
+// authenticated as the pairing API.
+const PathPresence = "/presence"
+
+// The headers a client tells about itself when connecting, see Presence.
+const (
+	HeaderClientVersion  = "Client-Version"
+	HeaderClientHandlers = "Client-Handlers"
+)
+
+// Presence is the status of a client in a room. The server sends it in a
+// FramePresence when a client joins or leaves.
+type Presence struct {
+	// ID is the hash of the client id, see PresenceID.
+	ID   string `json:"id"`
+	Name string `json:"name"`
+
+	// Version is the build version of the client, Protocol is the protocol
+	// version negotiated.
+	Version  string `json:"version"`
+	Protocol int    `json:"protocol"`
+
+	// Handlers is the handlers enabled, such as "clipboard".
+	Handlers []string `json:"handlers"`
+
+	Online bool `json:"online"`
+
+	// Since (unix nanoseconds) is when the client joined if online, or
+	// left if offline.
+	Since int64 `json:"since"`
+
+	// LastSeen (unix nanoseconds) is when anything, including heartbeats,
+	// is received from the client, LastActive is when data is received.
+	LastSeen   int64 `json:"last_seen"`
+	LastActive int64 `json:"last_active"`
+
+	// Self is true for the client requesting PathPresence, it is not sent
+	// in frames.
+	Self bool `json:"self,omitempty"`
+}
+
+// PresenceID returns the id of a client shown to others. The client id
+// takes over the sessions with the same id, so it is not exposed.
+func PresenceID(id string) string {
+	sum := sha256.Sum256([]byte("wshare-presence\n" + id))
+	return hex.EncodeToString(sum[:8])
+}
+
+// The fields of a presence.
+const (
+	presenceID         = 1
+	presenceName       = 2
+	presenceVersion    = 3
+	presenceProtocol   = 4
+	presenceHandler    = 5
+	presenceOnline     = 6
+	presenceSince      = 7
+	presenceLastSeen   = 8
+	presenceLastActive = 9
+)
+
+func (p *Presence) MarshalBinary() ([]byte, error) {
+	var e wire.Encoder
+	e.String(presenceID, p.ID)
+	e.String(presenceName, p.Name)
+	e.String(presenceVersion, p.Version)
+	e.Uint(presenceProtocol, uint64(p.Protocol))
+	e.Strings(presenceHandler, p.Handlers)
+	if p.Online {
+		e.Uint(presenceOnline, 1)
+	}
+	e.Int(presenceSince, p.Since)
+	e.Int(presenceLastSeen, p.LastSeen)
+	e.Int(presenceLastActive, p.LastActive)
+	return e.Bytes(), nil
+}
+
+func (p *Presence) UnmarshalBinary(data []byte) error {
+	return wire.Unmarshal(data, func(tag uint64, value []byte) error {
+		var err error
+		switch tag {
+		case presenceID:
+			p.ID = string(value)
+		case presenceName:
+			p.Name = string(value)
+		case presenceVersion:
+			p.Version = string(value)
+		case presenceProtocol:
+			p.Protocol, err = decodeInt(value)
+		case presenceHandler:
+			p.Handlers = append(p.Handlers, string(value))
+		case presenceOnline:
+			var online uint64
+			online, err = wire.Uint(value)
+			p.Online = online != 0
+		case presenceSince:
+			p.Since, err = wire.Int(value)
+		case presenceLastSeen:
+			p.LastSeen, err = wire.Int(value)
+		case presenceLastActive:
+			p.LastActive, err = wire.Int(value)
+		}
+		return err
+	})
+}
+
+// BuildVersion returns the version of the binary, "(devel)" if it is not
+// installed from a release.
+func BuildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok || info.Main.Version == "" {
+		return "(devel)"
+	}
+	return info.Main.Version
+}
+
+// FormatHandlers formats the names of the handlers registered, for
+// HeaderClientHandlers.
+func FormatHandlers() string {
+	names := make([]string, 0, len(handlers))
+	for name := range handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fioncat/wshare/pkg/crypto"
+	"github.com/fioncat/wshare/pkg/log"
+	"github.com/fioncat/wshare/share"
+	"github.com/fioncat/wshare/share/device"
+)
+
+const (
+	nonceTTL = time.Second * 30
+
+	// A nonce is the time it is issued (8 bytes), random bytes and the
+	// truncated HMAC of them.
+	nonceRandomSize = 16
+	nonceMACSize    = 16
+	nonceSize       = 8 + nonceRandomSize + nonceMACSize
+)
+
+// challenges issues one-time nonces for the authentication handshake.
+//
+// The nonces are stateless, they are checked by the HMAC with a key only
+// known by the server, so asking for them does not take any memory. A
+// nonce is remembered only after a client proves it knows the password
+// with it, so that it cannot be used again.
+type challenges struct {
+	key []byte
+
+	mu sync.Mutex
+
+	// used is the nonces used, by the time they expire.
+	used map[string]time.Time
+}
+
+func newChallenges() *challenges {
+	key := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, key)
+	if err != nil {
+		panic(fmt.Sprintf("failed to generate challenge key: %v", err))
+	}
+	return &challenges{key: key, used: make(map[string]time.Time)}
+}
+
+func (c *challenges) issue(now time.Time) (string, error) {
+	buf := make([]byte, 8+nonceRandomSize, nonceSize)
+	binary.BigEndian.PutUint64(buf, uint64(now.UnixNano()))
+	_, err := io.ReadFull(rand.Reader, buf[8:])
+	if err != nil {
+		return "", err
+	}
+	buf = append(buf, c.sum(buf)...)
+	return hex.EncodeToString(buf), nil
+}
+
+func (c *challenges) sum(data []byte) []byte {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write(data)
+	return mac.Sum(nil)[:nonceMACSize]
+}
+
+// check reports whether the nonce is issued by us and not expired, and
+// returns when it expires. It does not tell whether it is used.
+func (c *challenges) check(nonce string, now time.Time) (time.Time, bool) {
+	buf, err := hex.DecodeString(nonce)
+	if err != nil || len(buf) != nonceSize {
+		return time.Time{}, false
+	}
+	data, sum := buf[:8+nonceRandomSize], buf[8+nonceRandomSize:]
+	if !hmac.Equal(sum, c.sum(data)) {
+		return time.Time{}, false
+	}
+	issued := time.Unix(0, int64(binary.BigEndian.Uint64(data)))
+	expire := issued.Add(nonceTTL)
+	if now.Before(issued) || !now.Before(expire) {
+		return time.Time{}, false
+	}
+	return expire, true
+}
+
+// use marks the nonce checked as used, returns false if it is used
+// before.
+func (c *challenges) use(nonce string, expire, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for n, e := range c.used {
+		if !now.Before(e) {
+			delete(c.used, n)
+		}
+	}
+	if _, ok := c.used[nonce]; ok {
+		return false
+	}
+	c.used[nonce] = expire
+	return true
+}
+
+var authChallenges = newChallenges()
+
+// handleChallenge replies a nonce, and the crypto header of the room key
+// (see crypto.Key.Header), the client must authenticate with the same
+// key derivation parameters.
+func handleChallenge(w http.ResponseWriter, r *http.Request) {
+	roomName := r.URL.Query().Get("room")
+	rm := rooms[roomName]
+	if rm == nil {
+		http.Error(w, fmt.Sprintf("unknown room %q", roomName), http.StatusNotFound)
+		return
+	}
+	nonce, err := authChallenges.issue(time.Now())
+	if err != nil {
+		log.Get().Errorf("failed to issue challenge: %v", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintf(w, "%s\n%s", nonce, base64.StdEncoding.EncodeToString(rm.Key.Header()))
+}
+
+// authenticate checks the handshake headers of a request, returns the
+// room to join, and the device if pairing is enabled.
+func authenticate(r *http.Request) (*room, *device.Device, error) {
+	rm, nonce, err := authenticateRoom(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if rm.pairing == nil {
+		return rm, nil, nil
+	}
+	key, err := verifyDevice(r, rm, nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	name := r.Header.Get("client-name")
+	d := rm.pairing.devices.Get(name, key)
+	if d == nil {
+		return nil, nil, fmt.Errorf("device %s is not paired", crypto.Fingerprint(key))
+	}
+	rm.pairing.updateBoxKey(d, r)
+	return rm, d, nil
+}
+
+// authenticateRoom checks that the client knows the password of the room,
+// returns the room and the nonce used.
+func authenticateRoom(r *http.Request) (*room, string, error) {
+	nonce := r.Header.Get(share.HeaderAuthNonce)
+	if nonce == "" {
+		return nil, "", errors.New("missing auth headers")
+	}
+	expire, ok := authChallenges.check(nonce, time.Now())
+	if !ok {
+		return nil, "", errors.New("invalid or expired nonce")
+	}
+	sum, err := hex.DecodeString(r.Header.Get(share.HeaderAuthMAC))
+	if err != nil {
+		return nil, "", errors.New("invalid mac")
+	}
+	roomName := r.Header.Get(share.HeaderRoom)
+	rm := rooms[roomName]
+	if rm == nil {
+		return nil, "", fmt.Errorf("unknown room %q", roomName)
+	}
+	kdfHeader, err := base64Header(r, share.HeaderAuthKDF)
+	if err != nil {
+		return nil, "", errors.New("missing crypto header, the client may be too old")
+	}
+	name := r.Header.Get("client-name")
+	ok, err = rm.Key.CheckMAC(kdfHeader, share.AuthMessage(nonce, roomName, name, r.Header.Get(share.HeaderClientID)), sum)
+	if err != nil {
+		return nil, "", err
+	}
+	if !ok {
+		return nil, "", errors.New("wrong password")
+	}
+	if !authChallenges.use(nonce, expire, time.Now()) {
+		return nil, "", errors.New("nonce is already used")
+	}
+	return rm, nonce, nil
+}
+
+// verifyDevice checks the signature of the device, returns its public
+// key. It does not check whether the device is trusted.
+func verifyDevice(r *http.Request, rm *room, nonce string) ([]byte, error) {
+	key, err := base64Header(r, share.HeaderAuthDevice)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := hex.DecodeString(r.Header.Get(share.HeaderAuthSignature))
+	if err != nil {
+		return nil, errors.New("invalid signature")
+	}
+	name := r.Header.Get("client-name")
+	msg := share.SignMessage(nonce, rm.Name, name, r.Header.Get(share.HeaderClientID), r.URL.RequestURI())
+	if !crypto.Verify(key, msg, sig) {
+		return nil, errors.New("wrong signature")
+	}
+	return key, nil
+}
+
+func base64Header(r *http.Request, name string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(r.Header.Get(name))
+	if err != nil || len(data) == 0 {
+		return nil, fmt.Errorf("missing or invalid header %s", name)
+	}
+	return data, nil
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChallenges(t *testing.T) {
+	c := newChallenges()
+	now := time.Now()
+	nonce, err := c.issue(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Issuing does not take any memory.
+	for i := 0; i < 100; i++ {
+		_, err = c.issue(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(c.used) != 0 {
+		t.Fatalf("expect no nonce to be kept, got %d", len(c.used))
+	}
+
+	forged := []byte(nonce)
+	forged[0] ^= 1
+	for _, tc := range []struct {
+		name  string
+		nonce string
+		now   time.Time
+		ok    bool
+	}{
+		{name: "valid", nonce: nonce, now: now.Add(time.Second), ok: true},
+		{name: "expired", nonce: nonce, now: now.Add(nonceTTL)},
+		{name: "future", nonce: nonce, now: now.Add(-time.Second)},
+		{name: "forged", nonce: string(forged), now: now},
+		{name: "other key", nonce: mustIssue(t, newChallenges(), now), now: now},
+		{name: "invalid", nonce: "abc", now: now},
+	} {
+		_, ok := c.check(tc.nonce, tc.now)
+		if ok != tc.ok {
+			t.Fatalf("%s: expect %v, got %v", tc.name, tc.ok, ok)
+		}
+	}
+
+	expire, _ := c.check(nonce, now)
+	if !c.use(nonce, expire, now) {
+		t.Fatal("expect nonce to be used")
+	}
+	if c.use(nonce, expire, now) {
+		t.Fatal("expect nonce to be used only once")
+	}
+	// The used nonces are forgotten after expired.
+	other := mustIssue(t, c, now.Add(nonceTTL))
+	otherExpire, _ := c.check(other, now.Add(nonceTTL))
+	if !c.use(other, otherExpire, now.Add(nonceTTL)) {
+		t.Fatal("expect other nonce to be used")
+	}
+	if _, ok := c.used[nonce]; ok {
+		t.Fatal("expect expired nonce to be forgotten")
+	}
+}
+
+func mustIssue(t *testing.T, c *challenges, now time.Time) string {
+	nonce, err := c.issue(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nonce
+}
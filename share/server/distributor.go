@@ -0,0 +1,497 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fioncat/wshare/config"
+	"github.com/fioncat/wshare/pkg/log"
+	"github.com/fioncat/wshare/share"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	OverflowDropOldest = "drop-oldest"
+	OverflowDropNewest = "drop-newest"
+	OverflowDisconnect = "disconnect"
+)
+
+// FanoutOptions controls how messages are delivered to clients.
+type FanoutOptions struct {
+	// Buffer is the number of messages buffered for each client.
+	Buffer int
+
+	// Overflow is what to do when a client's buffer is full.
+	Overflow string
+}
+
+func LoadFanoutOptions() (*FanoutOptions, error) {
+	cfg := config.Get().Fanout
+	switch cfg.Overflow {
+	case OverflowDropOldest, OverflowDropNewest, OverflowDisconnect:
+	default:
+		return nil, fmt.Errorf("unknown overflow policy %q", cfg.Overflow)
+	}
+	return &FanoutOptions{
+		Buffer:   cfg.Buffer,
+		Overflow: cfg.Overflow,
+	}, nil
+}
+
+// Session is a registered client. Messages for it are buffered in C, the
+// sending never blocks: when C is full, the overflow policy is applied.
+type Session struct {
+	// ID identifies the client, Name is only a label, several clients
+	// can have the same name.
+	ID   string
+	Name string
+
+	C chan []byte
+
+	kicked     chan struct{}
+	kickOnce   sync.Once
+	kickCode   int
+	kickReason string
+
+	mu      sync.Mutex
+	slow    bool
+	dropped uint64
+
+	presence share.Presence
+}
+
+// Touch is called when anything is received from the client, active is
+// true for data.
+func (s *Session) Touch(active bool) {
+	now := time.Now().UnixNano()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.presence.LastSeen = now
+	if active {
+		s.presence.LastActive = now
+	}
+}
+
+// Presence returns the status of the client.
+func (s *Session) Presence() *share.Presence {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.presence
+	return &p
+}
+
+// Kicked is closed when the session should be disconnected, such as by
+// the overflow policy. See KickReason for why.
+func (s *Session) Kicked() <-chan struct{} {
+	return s.kicked
+}
+
+func (s *Session) KickReason() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.kickReason
+}
+
+// KickCode is the websocket close code to send to the client.
+func (s *Session) KickCode() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.kickCode
+}
+
+func (s *Session) kick(code int, reason string) {
+	s.kickOnce.Do(func() {
+		s.mu.Lock()
+		s.kickCode = code
+		s.kickReason = reason
+		s.mu.Unlock()
+		close(s.kicked)
+	})
+}
+
+// offer sends data to the session without blocking.
+func (s *Session) offer(data []byte, policy string) {
+	select {
+	case s.C <- data:
+		s.markSlow(false, policy)
+		return
+	default:
+	}
+
+	s.markSlow(true, policy)
+	switch policy {
+	case OverflowDropOldest:
+		select {
+		case <-s.C:
+			s.drop()
+		default:
+		}
+		select {
+		case s.C <- data:
+		default:
+			s.drop()
+		}
+
+	case OverflowDropNewest:
+		s.drop()
+
+	case OverflowDisconnect:
+		s.kick(websocket.CloseTryAgainLater, "client is too slow")
+	}
+}
+
+func (s *Session) drop() {
+	s.mu.Lock()
+	s.dropped++
+	s.mu.Unlock()
+}
+
+// drain takes the messages buffered in the session.
+func (s *Session) drain() [][]byte {
+	var msgs [][]byte
+	for {
+		select {
+		case data := <-s.C:
+			msgs = append(msgs, data)
+		default:
+			return msgs
+		}
+	}
+}
+
+// markSlow logs when the session becomes slow, and when it recovers. To
+// avoid flapping, it recovers only after the buffer is half empty.
+func (s *Session) markSlow(slow bool, policy string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if slow == s.slow {
+		return
+	}
+	logger := log.Get().WithField("client", s.Name).WithField("id", s.ID)
+	if slow {
+		s.slow = true
+		logger.Warnf("client is slow, buffer of %d messages is full, apply policy %s", cap(s.C), policy)
+		return
+	}
+	if len(s.C) > cap(s.C)/2 {
+		return
+	}
+	s.slow = false
+	logger.Infof("client recovered from slow, %d messages dropped in total", s.dropped)
+}
+
+// maxOffline is the max number of the clients left to remember.
+const maxOffline = 100
+
+type Distributor struct {
+	mu sync.RWMutex
+
+	// clients is the online clients by id.
+	clients map[string]*Session
+
+	// offline is the clients left, by id, see Roster.
+	offline map[string]*share.Presence
+
+	fanoutOpts *FanoutOptions
+
+	// queues keeps messages for the known clients while they are
+	// offline, by id. names is the ids of the queues by client name, to
+	// find the queues of a target.
+	queues    map[string]*queue
+	names     map[string]map[string]struct{}
+	queueOpts *QueueOptions
+}
+
+func NewDistributor(queueOpts *QueueOptions, fanoutOpts *FanoutOptions) (*Distributor, error) {
+	queues, err := loadQueues(queueOpts)
+	if err != nil {
+		return nil, err
+	}
+	d := &Distributor{
+		clients:    make(map[string]*Session),
+		offline:    make(map[string]*share.Presence),
+		fanoutOpts: fanoutOpts,
+		queues:     queues,
+		names:      make(map[string]map[string]struct{}),
+		queueOpts:  queueOpts,
+	}
+	for id, q := range queues {
+		d.addName(q.name, id)
+	}
+	return d, nil
+}
+
+// addName adds the id to the queues of the name. The caller must hold the
+// lock.
+func (d *Distributor) addName(name, id string) {
+	ids := d.names[name]
+	if ids == nil {
+		ids = make(map[string]struct{})
+		d.names[name] = ids
+	}
+	ids[id] = struct{}{}
+}
+
+// removeName removes the id from the queues of the name. The caller must
+// hold the lock.
+func (d *Distributor) removeName(name, id string) {
+	delete(d.names[name], id)
+	if len(d.names[name]) == 0 {
+		delete(d.names, name)
+	}
+}
+
+// Register registers a client, with its id, name, version and handlers in
+// info, returns its session and the messages queued while it was offline.
+// If the id is online, the client is reconnecting before the old connection
+// is closed, such as after a laptop sleeps: the old session is kicked, and
+// its pending messages are taken over. If queue is true, messages are
+// queued for the id after it deregisters.
+func (d *Distributor) Register(info *share.Presence, queue bool) (*Session, [][]byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	id, name := info.ID, info.Name
+	now := time.Now().UnixNano()
+	presence := *info
+	presence.Online = true
+	presence.Since = now
+	presence.LastSeen = now
+	delete(d.offline, id)
+
+	var backlog [][]byte
+	if old := d.clients[id]; old != nil {
+		old.kick(share.CloseReplaced, "replaced by a new connection")
+		backlog = old.drain()
+	}
+
+	s := &Session{
+		ID:       id,
+		Name:     name,
+		C:        make(chan []byte, d.fanoutOpts.Buffer),
+		kicked:   make(chan struct{}),
+		presence: presence,
+	}
+	d.clients[id] = s
+
+	if q := d.queues[id]; q != nil {
+		q.touch()
+		backlog = append(q.take(), backlog...)
+		if old := q.getName(); old != name {
+			// The client is renamed, the messages to the old name are
+			// not queued for it anymore.
+			d.removeName(old, id)
+			q.setName(name)
+			d.addName(name, id)
+		}
+	}
+	if queue && d.queueOpts.MaxSize > 0 && d.queues[id] == nil {
+		q, err := newQueue(id, name, d.queueOpts)
+		if err != nil {
+			log.Get().Errorf("failed to create queue for %s: %v", name, err)
+		} else {
+			d.queues[id] = q
+			d.addName(name, id)
+		}
+	}
+	return s, backlog
+}
+
+// Deregister removes the session, returns the presence of the client left,
+// nil if the session is taken over by a new one.
+func (d *Distributor) Deregister(s *Session) *share.Presence {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.clients[s.ID] != s {
+		return nil
+	}
+	delete(d.clients, s.ID)
+	close(s.C)
+	if q := d.queues[s.ID]; q != nil {
+		q.touch()
+	}
+
+	p := s.Presence()
+	p.Online = false
+	p.Since = time.Now().UnixNano()
+	d.offline[s.ID] = p
+	if len(d.offline) > maxOffline {
+		var oldest *share.Presence
+		for _, p := range d.offline {
+			if oldest == nil || p.Since < oldest.Since {
+				oldest = p
+			}
+		}
+		delete(d.offline, oldest.ID)
+	}
+	return p
+}
+
+// Touch updates the last seen time of the client, see Session.Touch.
+func (d *Distributor) Touch(id string, active bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if s := d.clients[id]; s != nil {
+		s.Touch(active)
+	}
+}
+
+// Roster returns the clients online, and the clients left since the server
+// started, sorted by name.
+func (d *Distributor) Roster() []*share.Presence {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	roster := make([]*share.Presence, 0, len(d.clients)+len(d.offline))
+	for _, s := range d.clients {
+		roster = append(roster, s.Presence())
+	}
+	for _, p := range d.offline {
+		copied := *p
+		roster = append(roster, &copied)
+	}
+	sort.Slice(roster, func(i, j int) bool {
+		if roster[i].Name != roster[j].Name {
+			return roster[i].Name < roster[j].Name
+		}
+		return roster[i].ID < roster[j].ID
+	})
+	return roster
+}
+
+// Broadcast sends data to all the online clients except the id, without
+// queueing.
+func (d *Distributor) Broadcast(except string, data []byte) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for id, s := range d.clients {
+		if id != except {
+			s.offer(data, d.fanoutOpts.Overflow)
+		}
+	}
+}
+
+// Kick disconnects the clients with the name.
+func (d *Distributor) Kick(name, reason string) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, s := range d.clients {
+		if s.Name == name {
+			s.kick(websocket.ClosePolicyViolation, reason)
+		}
+	}
+}
+
+// Send sends data to the client if it is online, without blocking.
+func (d *Distributor) Send(id string, data []byte) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if s := d.clients[id]; s != nil {
+		s.offer(data, d.fanoutOpts.Overflow)
+	}
+}
+
+// Notify sends data from the client id to the clients named in to, or all
+// the other clients if to is empty, returns the names sent or queued to.
+// transfer is the id of the transfer the data belongs to, empty for a
+// single frame, see queue.push. It never blocks on a slow client, see
+// Session, and the queues are written without holding the lock.
+func (d *Distributor) Notify(id string, data []byte, transfer string, to []string) []string {
+	sent, queues := d.route(id, data, to)
+	if len(queues) == 0 {
+		return sent
+	}
+	for _, q := range queues {
+		q.push(data, transfer)
+	}
+
+	// The client may register after the queue is chosen, and before the
+	// data is pushed, take it again to not leave it in the queue.
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for qid, q := range queues {
+		if s := d.clients[qid]; s != nil {
+			for _, data := range q.take() {
+				s.offer(data, d.fanoutOpts.Overflow)
+			}
+		}
+	}
+	return sent
+}
+
+// route sends data to the online clients, returns the names sent or to
+// queue to, and the queues to push to by id.
+func (d *Distributor) route(id string, data []byte, to []string) ([]string, map[string]*queue) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	want := func(target string) bool {
+		if len(to) == 0 {
+			return true
+		}
+		for _, t := range to {
+			if t == target {
+				return true
+			}
+		}
+		return false
+	}
+
+	sent := make(map[string]bool)
+	for _, s := range d.clients {
+		if s.ID != id && want(s.Name) {
+			s.offer(data, d.fanoutOpts.Overflow)
+			sent[s.Name] = true
+		}
+	}
+	queues := make(map[string]*queue)
+	enqueue := func(target, qid string) {
+		if qid == id || d.clients[qid] != nil {
+			return
+		}
+		if q := d.queues[qid]; q != nil {
+			queues[qid] = q
+			sent[target] = true
+		}
+	}
+	if len(to) == 0 {
+		for target, ids := range d.names {
+			for qid := range ids {
+				enqueue(target, qid)
+			}
+		}
+	}
+	for _, target := range to {
+		for qid := range d.names[target] {
+			enqueue(target, qid)
+		}
+	}
+	targets := make([]string, 0, len(sent))
+	for target := range sent {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	return targets, queues
+}
+
+// ExpireQueues removes the queues of the clients not seen for the queue
+// ttl, their messages are expired anyway.
+func (d *Distributor) ExpireQueues() {
+	now := time.Now()
+	var expired []*queue
+	d.mu.Lock()
+	for id, q := range d.queues {
+		if d.clients[id] != nil || now.Sub(q.getSeen()) < d.queueOpts.TTL {
+			continue
+		}
+		delete(d.queues, id)
+		d.removeName(q.getName(), id)
+		expired = append(expired, q)
+	}
+	d.mu.Unlock()
+
+	for _, q := range expired {
+		q.destroy()
+	}
+}
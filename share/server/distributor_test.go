@@ -0,0 +1,286 @@
+package server
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fioncat/wshare/config"
+	"github.com/fioncat/wshare/pkg/log"
+	"github.com/fioncat/wshare/share"
+)
+
+func initLog(t *testing.T) {
+	t.Setenv("WSHARE_CONFIG", filepath.Join(t.TempDir(), "daemon.yaml"))
+	err := config.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = log.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func strs(msgs [][]byte) []string {
+	var ret []string
+	for _, msg := range msgs {
+		ret = append(ret, string(msg))
+	}
+	return ret
+}
+
+func TestOverflow(t *testing.T) {
+	initLog(t)
+	for _, c := range []struct {
+		policy string
+		want   []string
+		kicked bool
+	}{
+		{policy: OverflowDropOldest, want: []string{"b", "c"}},
+		{policy: OverflowDropNewest, want: []string{"a", "b"}},
+		{policy: OverflowDisconnect, want: []string{"a", "b"}, kicked: true},
+	} {
+		s := &Session{
+			Name:   "test",
+			C:      make(chan []byte, 2),
+			kicked: make(chan struct{}),
+		}
+		for _, msg := range []string{"a", "b", "c"} {
+			s.offer([]byte(msg), c.policy)
+		}
+		got := strs(s.drain())
+		if !reflect.DeepEqual(got, c.want) {
+			t.Fatalf("%s: expect %v, got %v", c.policy, c.want, got)
+		}
+		var kicked bool
+		select {
+		case <-s.Kicked():
+			kicked = true
+		default:
+		}
+		if kicked != c.kicked {
+			t.Fatalf("%s: expect kicked %v, got %v", c.policy, c.kicked, kicked)
+		}
+	}
+}
+
+func TestQueue(t *testing.T) {
+	initLog(t)
+	for _, c := range []struct {
+		name    string
+		maxSize int64
+		ttl     time.Duration
+		push    []string
+		want    []string
+	}{
+		{name: "keep", maxSize: 10, ttl: time.Hour, push: []string{"ab", "cd"}, want: []string{"ab", "cd"}},
+		{name: "size", maxSize: 5, ttl: time.Hour, push: []string{"abc", "de", "fg"}, want: []string{"de", "fg"}},
+		{name: "too large", maxSize: 5, ttl: time.Hour, push: []string{"ab", "cdefgh"}, want: []string{"ab"}},
+		{name: "ttl", maxSize: 10, ttl: time.Nanosecond, push: []string{"ab", "cd"}},
+	} {
+		for _, persist := range []bool{false, true} {
+			opts := &QueueOptions{MaxSize: c.maxSize, TTL: c.ttl}
+			if persist {
+				opts.Dir = t.TempDir()
+			}
+			q, err := newQueue("id", "name", opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, msg := range c.push {
+				q.push([]byte(msg), "")
+			}
+			if persist {
+				// Take from the queue loaded, as after restarting.
+				queues, err := loadQueues(opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				q = queues["id"]
+				if q == nil || q.name != "name" {
+					t.Fatalf("%s: expect queue of name to be loaded", c.name)
+				}
+			}
+			got := strs(q.take())
+			if !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("%s (persist %v): expect %v, got %v", c.name, persist, c.want, got)
+			}
+		}
+	}
+}
+
+func TestQueueTransfers(t *testing.T) {
+	initLog(t)
+	type frame struct {
+		data     string
+		transfer string
+	}
+	for _, c := range []struct {
+		name string
+		push []frame
+		want []string
+	}{
+		{
+			name: "evict whole transfer",
+			push: []frame{{"ab", "t1"}, {"cd", "t1"}, {"x", ""}, {"ef", "t2"}, {"gh", "t2"}},
+			want: []string{"x", "ef", "gh"},
+		},
+		{
+			name: "refuse evicted transfer",
+			push: []frame{{"ab", "t1"}, {"cd", "t1"}, {"ef", "t2"}, {"gh", "t2"}, {"ij", "t1"}},
+			want: []string{"ef", "gh"},
+		},
+		{
+			name: "refuse large transfer",
+			push: []frame{{"x", ""}, {"abcd", "t1"}, {"efgh", "t1"}, {"ij", "t1"}},
+			want: []string{"x"},
+		},
+	} {
+		for _, persist := range []bool{false, true} {
+			opts := &QueueOptions{MaxSize: 6, TTL: time.Hour}
+			if persist {
+				opts.Dir = t.TempDir()
+			}
+			q, err := newQueue("id", "name", opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range c.push {
+				q.push([]byte(f.data), f.transfer)
+			}
+			if persist {
+				queues, err := loadQueues(opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				q = queues["id"]
+			}
+			got := strs(q.take())
+			if !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("%s (persist %v): expect %v, got %v", c.name, persist, c.want, got)
+			}
+		}
+	}
+}
+
+func TestExpireQueues(t *testing.T) {
+	initLog(t)
+	opts := &QueueOptions{MaxSize: 1024, TTL: time.Hour, Dir: t.TempDir()}
+	d, err := NewDistributor(opts, &FanoutOptions{Buffer: 8, Overflow: OverflowDropNewest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"gone", "back"} {
+		s, _ := d.Register(&share.Presence{ID: id, Name: id}, true)
+		d.Deregister(s)
+	}
+	d.queues["gone"].seen = time.Now().Add(-2 * time.Hour)
+	d.ExpireQueues()
+
+	if d.queues["gone"] != nil || d.names["gone"] != nil {
+		t.Fatal("expect queue of the client gone to be removed")
+	}
+	if d.queues["back"] == nil {
+		t.Fatal("expect queue of the client seen to be kept")
+	}
+	queues, err := loadQueues(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queues["gone"] != nil {
+		t.Fatal("expect persisted queue to be removed")
+	}
+}
+
+func TestTakeover(t *testing.T) {
+	initLog(t)
+	d, err := NewDistributor(&QueueOptions{MaxSize: 1024, TTL: time.Hour}, &FanoutOptions{Buffer: 8, Overflow: OverflowDropNewest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &share.Presence{ID: "1", Name: "a"}
+	old, _ := d.Register(info, true)
+	d.Notify("2", []byte("pending"), "", nil)
+
+	s, backlog := d.Register(info, true)
+	select {
+	case <-old.Kicked():
+	default:
+		t.Fatal("expect old session to be kicked")
+	}
+	if got := strs(backlog); !reflect.DeepEqual(got, []string{"pending"}) {
+		t.Fatalf("expect pending messages to be taken over, got %v", got)
+	}
+
+	// The old session is replaced, deregistering it keeps the new one.
+	if d.Deregister(old) != nil {
+		t.Fatal("expect nil presence for replaced session")
+	}
+	d.Send("1", []byte("online"))
+	if got := strs(s.drain()); !reflect.DeepEqual(got, []string{"online"}) {
+		t.Fatalf("expect new session to be online, got %v", got)
+	}
+
+	p := d.Deregister(s)
+	if p == nil || p.Online {
+		t.Fatalf("expect offline presence, got %+v", p)
+	}
+	d.Notify("2", []byte("queued"), "", []string{"a"})
+	_, backlog = d.Register(info, true)
+	if got := strs(backlog); !reflect.DeepEqual(got, []string{"queued"}) {
+		t.Fatalf("expect queued messages, got %v", got)
+	}
+}
+
+func TestQueueNames(t *testing.T) {
+	initLog(t)
+	opts := &QueueOptions{MaxSize: 1024, TTL: time.Hour, Dir: t.TempDir()}
+	d, err := NewDistributor(opts, &FanoutOptions{Buffer: 8, Overflow: OverflowDropNewest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two clients with the same name, both queue messages to the name.
+	for _, id := range []string{"1", "2"} {
+		s, _ := d.Register(&share.Presence{ID: id, Name: "a"}, true)
+		d.Deregister(s)
+	}
+	// 2 is renamed, messages to a are not queued for it anymore.
+	s, _ := d.Register(&share.Presence{ID: "2", Name: "b"}, true)
+	d.Deregister(s)
+
+	for _, c := range []struct {
+		to      []string
+		targets []string
+	}{
+		{to: []string{"a"}, targets: []string{"a"}},
+		{to: []string{"b"}, targets: []string{"b"}},
+		{to: []string{"c"}, targets: []string{}},
+		{targets: []string{"a", "b"}},
+	} {
+		targets := d.Notify("3", []byte("x"), "", c.to)
+		if !reflect.DeepEqual(targets, c.targets) {
+			t.Fatalf("notify %v: expect %v, got %v", c.to, c.targets, targets)
+		}
+	}
+
+	// The name is persisted, the mapping is the same after restarting.
+	d, err = NewDistributor(opts, &FanoutOptions{Buffer: 8, Overflow: OverflowDropNewest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		id   string
+		name string
+		want int
+	}{
+		{id: "1", name: "a", want: 2},
+		{id: "2", name: "b", want: 2},
+	} {
+		_, backlog := d.Register(&share.Presence{ID: c.id, Name: c.name}, true)
+		if len(backlog) != c.want {
+			t.Fatalf("%s: expect %d messages, got %d", c.id, c.want, len(backlog))
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/fioncat/wshare/config"
+	"github.com/fioncat/wshare/pkg/crypto"
+	"github.com/fioncat/wshare/pkg/log"
+	"github.com/fioncat/wshare/share"
+	"github.com/fioncat/wshare/share/device"
+)
+
+const (
+	pairTTL = time.Minute * 5
+
+	maxPending = 100
+)
+
+type pendingDevice struct {
+	device *device.Device
+
+	expire   time.Time
+	approved bool
+}
+
+// pairing keeps the trust store of a room, and the devices waiting to be
+// approved by a paired device.
+type pairing struct {
+	devices *device.Store
+
+	mu      sync.Mutex
+	pending map[string]*pendingDevice
+}
+
+func newPairing(room string) (*pairing, error) {
+	name := "devices.json"
+	if room != "" {
+		name = "devices-" + url.PathEscape(room) + ".json"
+	}
+	path, err := config.LocalFile(name)
+	if err != nil {
+		return nil, err
+	}
+	store, err := device.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	return &pairing{
+		devices: store,
+		pending: make(map[string]*pendingDevice),
+	}, nil
+}
+
+// request adds a pending device, returns the code to approve it.
+func (p *pairing) request(d *device.Device) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for code, pending := range p.pending {
+		if now.After(pending.expire) {
+			delete(p.pending, code)
+		}
+	}
+	if len(p.pending) >= maxPending {
+		return "", errors.New("too many pending pairing requests")
+	}
+
+	for {
+		n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+		if err != nil {
+			return "", err
+		}
+		code := fmt.Sprintf("%06d", n.Int64())
+		if _, ok := p.pending[code]; ok {
+			continue
+		}
+		p.pending[code] = &pendingDevice{
+			device: d,
+			expire: now.Add(pairTTL),
+		}
+		return code, nil
+	}
+}
+
+// get returns the pending device with the code, nil if it does not exist
+// or is expired.
+func (p *pairing) get(code string) *pendingDevice {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pending := p.pending[code]
+	if pending == nil {
+		return nil
+	}
+	if time.Now().After(pending.expire) {
+		delete(p.pending, code)
+		return nil
+	}
+	return pending
+}
+
+func (p *pairing) approve(code string, replace bool) (*device.Device, error) {
+	pending := p.get(code)
+	if pending == nil {
+		return nil, nil
+	}
+	err := p.devices.Add(pending.device, replace)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	pending.approved = true
+	p.mu.Unlock()
+	return pending.device, nil
+}
+
+// status returns the status of the pending device, the approved one is
+// removed after its status is read.
+func (p *pairing) status(code string, key []byte) string {
+	pending := p.get(code)
+	if pending == nil || string(pending.device.Key) != string(key) {
+		return device.StatusExpired
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pending.approved {
+		delete(p.pending, code)
+		return device.StatusApproved
+	}
+	return device.StatusPending
+}
+
+// setBoxKey sets the box key from the request headers, if it is valid.
+// Returns true if the box key is changed.
+func setBoxKey(d *device.Device, r *http.Request) bool {
+	boxKey, err := base64Header(r, share.HeaderAuthBoxKey)
+	if err != nil {
+		return false
+	}
+	sig, err := base64Header(r, share.HeaderAuthBoxKeySig)
+	if err != nil {
+		return false
+	}
+	if bytes.Equal(boxKey, d.BoxKey) || !crypto.VerifyBoxKey(d.Key, boxKey, sig) {
+		return false
+	}
+	d.BoxKey, d.BoxKeySig = boxKey, sig
+	return true
+}
+
+// updateBoxKey saves the box key of a paired device, for the devices
+// paired before sending box keys.
+func (p *pairing) updateBoxKey(d *device.Device, r *http.Request) {
+	updated := *d
+	if !setBoxKey(&updated, r) {
+		return
+	}
+	err := p.devices.Add(&updated, false)
+	if err != nil {
+		log.Get().Errorf("failed to update box key of device %s: %v", d.Name, err)
+		return
+	}
+	log.Get().WithField("device", d.Name).Info("update box key of device")
+}
+
+func handlePairRequest(w http.ResponseWriter, r *http.Request) {
+	rm, nonce, err := authenticateRoom(r)
+	if err == nil && rm.pairing == nil {
+		err = errors.New("pairing is not enabled")
+	}
+	var key []byte
+	if err == nil {
+		key, err = verifyDevice(r, rm, nonce)
+	}
+	if err != nil {
+		http.Error(w, "authentication failed: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+	name := r.Header.Get("client-name")
+	if name == "" {
+		http.Error(w, "device name is required", http.StatusBadRequest)
+		return
+	}
+
+	d := &device.Device{
+		Name:  name,
+		Key:   key,
+		Added: time.Now(),
+	}
+	setBoxKey(d, r)
+	logger := log.Get().WithField("device", name).WithField("fingerprint", d.Fingerprint())
+	if rm.Name != "" {
+		logger = logger.WithField("room", rm.Name)
+	}
+
+	var resp device.Request
+	if rm.pairing.devices.Empty() {
+		// There is nobody to approve the first device, trust it.
+		err = rm.pairing.devices.Add(d, false)
+		if err != nil {
+			logger.Errorf("failed to add device: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logger.Warn("trust the first device without approving")
+		resp.Status = device.StatusApproved
+	} else {
+		resp.Code, err = rm.pairing.request(d)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		logger.Info("device requests pairing")
+		resp.Status = device.StatusPending
+	}
+	writeJSON(w, resp)
+}
+
+func handlePairStatus(w http.ResponseWriter, r *http.Request) {
+	rm := rooms[r.Header.Get(share.HeaderRoom)]
+	if rm == nil || rm.pairing == nil {
+		http.Error(w, "unknown room", http.StatusNotFound)
+		return
+	}
+	key, err := base64Header(r, share.HeaderAuthDevice)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	code := r.URL.Query().Get("code")
+	w.Write([]byte(rm.pairing.status(code, key)))
+}
+
+// handlePairPending shows the pending device with the code, so that it can
+// be checked before approving.
+func handlePairPending(w http.ResponseWriter, r *http.Request) {
+	rm, _ := authenticatePair(w, r)
+	if rm == nil {
+		return
+	}
+	pending := rm.pairing.get(r.URL.Query().Get("code"))
+	if pending == nil {
+		http.Error(w, "unknown or expired code", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, pending.device)
+}
+
+func handlePairApprove(w http.ResponseWriter, r *http.Request) {
+	rm, approver := authenticatePair(w, r)
+	if rm == nil {
+		return
+	}
+	query := r.URL.Query()
+	d, err := rm.pairing.approve(query.Get("code"), query.Get("replace") == "true")
+	if errors.Is(err, device.ErrExists) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Get().Errorf("failed to approve device: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if d == nil {
+		http.Error(w, "unknown or expired code", http.StatusNotFound)
+		return
+	}
+	log.Get().WithField("device", d.Name).WithField("fingerprint", d.Fingerprint()).
+		Infof("device is approved by %s", approver.Name)
+	writeJSON(w, d)
+}
+
+func handlePairList(w http.ResponseWriter, r *http.Request) {
+	rm, _ := authenticatePair(w, r)
+	if rm == nil {
+		return
+	}
+	writeJSON(w, rm.pairing.devices.List())
+}
+
+func handlePairRemove(w http.ResponseWriter, r *http.Request) {
+	rm, remover := authenticatePair(w, r)
+	if rm == nil {
+		return
+	}
+	name := r.URL.Query().Get("name")
+	ok, err := rm.pairing.devices.Remove(name)
+	if err != nil {
+		log.Get().Errorf("failed to remove device: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "unknown device", http.StatusNotFound)
+		return
+	}
+	log.Get().WithField("device", name).Infof("device is removed by %s", remover.Name)
+	rm.distributor.Kick(name, "device is removed")
+}
+
+// authenticatePair authenticates a request from a paired device, writes
+// the error and returns nil if failed.
+func authenticatePair(w http.ResponseWriter, r *http.Request) (*room, *device.Device) {
+	rm, d, err := authenticate(r)
+	if err == nil && d == nil {
+		err = errors.New("pairing is not enabled")
+	}
+	if err != nil {
+		http.Error(w, "authentication failed: "+err.Error(), http.StatusUnauthorized)
+		return nil, nil
+	}
+	return rm, d
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,442 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/fioncat/wshare/config"
+	"github.com/fioncat/wshare/pkg/log"
+	"github.com/fioncat/wshare/pkg/osutil"
+)
+
+// queueExpireInterval is how often the queues of the clients gone are
+// removed.
+const queueExpireInterval = time.Minute
+
+// QueueOptions controls the queues for offline clients.
+type QueueOptions struct {
+	// MaxSize is the max total size of the messages in one queue, the
+	// oldest messages are dropped when exceeded. Zero disables queueing.
+	MaxSize int64
+
+	TTL time.Duration
+
+	// Dir is where the queues are persisted, empty means memory only.
+	Dir string
+}
+
+// LoadQueueOptions reads the queue options from config.
+func LoadQueueOptions() (*QueueOptions, error) {
+	cfg := config.Get().Queue
+	maxSize, err := humanize.ParseBytes(cfg.MaxSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid queue max size %q: %v", cfg.MaxSize, err)
+	}
+	ttl, err := time.ParseDuration(cfg.TTL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid queue ttl %q: %v", cfg.TTL, err)
+	}
+	opts := &QueueOptions{
+		MaxSize: int64(maxSize),
+		TTL:     ttl,
+	}
+	if cfg.Persist {
+		opts.Dir, err = config.LocalFile("queue")
+		if err != nil {
+			return nil, err
+		}
+		err = osutil.EnsureDir(opts.Dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return opts, nil
+}
+
+// forRoom returns the options for the queues of a room. The queues of the
+// default room are persisted in Dir, others in "<Dir>-<room>".
+func (o *QueueOptions) forRoom(room string) (*QueueOptions, error) {
+	if o.Dir == "" || room == "" {
+		return o, nil
+	}
+	opts := *o
+	opts.Dir = o.Dir + "-" + url.PathEscape(room)
+	err := osutil.EnsureDir(opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	return &opts, nil
+}
+
+type queueItem struct {
+	data []byte
+
+	// transfer is the id of the transfer the frame belongs to, the frames
+	// of a transfer are kept or dropped together, so that a client never
+	// gets a transfer it cannot reassemble. Empty for a single frame.
+	transfer string
+
+	expire time.Time
+
+	// file is the path of the persisted message, empty if not persisted.
+	file string
+}
+
+// queueNameFile keeps the name of the client in the directory of a
+// persisted queue.
+const queueNameFile = "name"
+
+// queue keeps the messages for a client (by id) while it is offline, they
+// are sent when it registers again.
+type queue struct {
+	mu sync.Mutex
+
+	opts *QueueOptions
+
+	// name is the name of the client, the last one registered with the
+	// id, messages to the name are queued.
+	name string
+
+	// dir is where the messages are persisted, empty if not persisted.
+	dir string
+
+	items []*queueItem
+	size  int64
+
+	// dropped is the transfers dropped, by the time to forget them, their
+	// other frames are refused.
+	dropped map[string]time.Time
+
+	// seen is when the client was last seen, the queue is removed when
+	// the client is gone for the ttl, see Distributor.ExpireQueues.
+	seen time.Time
+
+	// closed is set when the queue is removed.
+	closed bool
+
+	seq uint64
+}
+
+func newQueue(id, name string, opts *QueueOptions) (*queue, error) {
+	q := &queue{
+		opts:    opts,
+		name:    name,
+		dropped: make(map[string]time.Time),
+		seen:    time.Now(),
+	}
+	dirName := url.PathEscape(id)
+	if opts.Dir == "" || dirName == "." || dirName == ".." {
+		return q, nil
+	}
+	q.dir = filepath.Join(opts.Dir, dirName)
+	err := osutil.EnsureDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	err = q.load()
+	if err != nil {
+		return nil, err
+	}
+	if name != "" {
+		q.setName(name)
+	}
+	return q, nil
+}
+
+// setName updates the name of the client.
+func (q *queue) setName(name string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.name = name
+	if q.dir == "" {
+		return
+	}
+	err := os.WriteFile(filepath.Join(q.dir, queueNameFile), []byte(name), 0600)
+	if err != nil {
+		log.Get().Errorf("failed to persist queue name: %v", err)
+	}
+}
+
+func (q *queue) getName() string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.name
+}
+
+// touch records that the client is seen, the time is kept as the mod time
+// of the name file when persisted.
+func (q *queue) touch() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.seen = time.Now()
+	if q.dir != "" {
+		os.Chtimes(filepath.Join(q.dir, queueNameFile), q.seen, q.seen)
+	}
+}
+
+func (q *queue) getSeen() time.Time {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.seen
+}
+
+// destroy removes the queue and the persisted messages.
+func (q *queue) destroy() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.items = nil
+	q.size = 0
+	if q.dir != "" {
+		err := os.RemoveAll(q.dir)
+		if err != nil {
+			log.Get().Errorf("failed to remove queue: %v", err)
+		}
+	}
+}
+
+// load reads the persisted messages. The file name is
+// "<expire-unix-nano>-<seq>[-<transfer>]", so that they can be sorted.
+func (q *queue) load() error {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if entry.Name() == queueNameFile {
+			name, err := os.ReadFile(filepath.Join(q.dir, queueNameFile))
+			if err != nil {
+				return err
+			}
+			q.name = string(name)
+			if info, err := entry.Info(); err == nil {
+				q.seen = info.ModTime()
+			}
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+
+	now := time.Now()
+	for _, name := range names {
+		path := filepath.Join(q.dir, name)
+		parts := strings.SplitN(name, "-", 3)
+		expireNano, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil || len(parts) < 2 {
+			log.Get().Warnf("invalid queue file %s, removed", path)
+			os.Remove(path)
+			continue
+		}
+		expire := time.Unix(0, expireNano)
+		if now.After(expire) {
+			os.Remove(path)
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		item := &queueItem{
+			data:   data,
+			expire: expire,
+			file:   path,
+		}
+		if len(parts) == 3 {
+			item.transfer, err = url.PathUnescape(parts[2])
+			if err != nil {
+				log.Get().Warnf("invalid queue file %s, removed", path)
+				os.Remove(path)
+				continue
+			}
+		}
+		q.items = append(q.items, item)
+		q.size += int64(len(data))
+	}
+	return nil
+}
+
+// push queues a frame, transfer is the id of the transfer it belongs to,
+// empty for a single frame. A transfer larger than the max size is refused
+// as a whole.
+func (q *queue) push(data []byte, transfer string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+
+	now := time.Now()
+	if _, ok := q.dropped[transfer]; ok && transfer != "" {
+		return
+	}
+	size := int64(len(data))
+	if transfer != "" {
+		for _, item := range q.items {
+			if item.transfer == transfer {
+				size += int64(len(item.data))
+			}
+		}
+	}
+	if size > q.opts.MaxSize {
+		if transfer != "" {
+			log.Get().Warnf("transfer %s is larger than the queue, drop it", transfer)
+			q.dropTransfer(transfer, now)
+		}
+		return
+	}
+
+	item := &queueItem{
+		data:     data,
+		transfer: transfer,
+		expire:   now.Add(q.opts.TTL),
+	}
+	if q.dir != "" {
+		q.seq++
+		name := fmt.Sprintf("%019d-%010d", item.expire.UnixNano(), q.seq)
+		if transfer != "" {
+			name += "-" + url.PathEscape(transfer)
+		}
+		path := filepath.Join(q.dir, name)
+		err := os.WriteFile(path, data, 0600)
+		if err != nil {
+			log.Get().Errorf("failed to persist queue message: %v", err)
+		} else {
+			item.file = path
+		}
+	}
+	q.items = append(q.items, item)
+	q.size += int64(len(data))
+
+	q.purge(now, transfer)
+}
+
+// purge drops the expired messages, and the oldest messages if the size
+// exceeds the limit, except the transfer keep being pushed. The frames of
+// a transfer are dropped together. The caller must hold the lock.
+func (q *queue) purge(now time.Time, keep string) {
+	for transfer, expire := range q.dropped {
+		if now.After(expire) {
+			delete(q.dropped, transfer)
+		}
+	}
+	for len(q.items) > 0 && !now.Before(q.items[0].expire) {
+		q.dropItem(q.items[0], now)
+	}
+	for q.size > q.opts.MaxSize {
+		var oldest *queueItem
+		for _, item := range q.items {
+			if item.transfer == "" || item.transfer != keep {
+				oldest = item
+				break
+			}
+		}
+		if oldest == nil {
+			return
+		}
+		q.dropItem(oldest, now)
+	}
+}
+
+// dropItem drops the item, or the whole transfer it belongs to. The caller
+// must hold the lock.
+func (q *queue) dropItem(drop *queueItem, now time.Time) {
+	if drop.transfer != "" {
+		q.dropTransfer(drop.transfer, now)
+		return
+	}
+	q.remove(func(item *queueItem) bool { return item == drop })
+}
+
+// dropTransfer drops the frames of the transfer, and refuses the frames
+// coming later. The caller must hold the lock.
+func (q *queue) dropTransfer(transfer string, now time.Time) {
+	q.remove(func(item *queueItem) bool { return item.transfer == transfer })
+	q.dropped[transfer] = now.Add(q.opts.TTL)
+}
+
+// remove removes the matched items. The caller must hold the lock.
+func (q *queue) remove(match func(item *queueItem) bool) {
+	items := q.items[:0]
+	for _, item := range q.items {
+		if !match(item) {
+			items = append(items, item)
+			continue
+		}
+		q.size -= int64(len(item.data))
+		if item.file != "" {
+			os.Remove(item.file)
+		}
+	}
+	for i := len(items); i < len(q.items); i++ {
+		q.items[i] = nil
+	}
+	q.items = items
+}
+
+// take removes and returns all the messages not expired.
+func (q *queue) take() [][]byte {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.purge(time.Now(), "")
+	msgs := make([][]byte, len(q.items))
+	for i, item := range q.items {
+		msgs[i] = item.data
+		if item.file != "" {
+			os.Remove(item.file)
+		}
+	}
+	q.items = nil
+	q.size = 0
+	return msgs
+}
+
+// loadQueues loads the persisted queues by client id, so the clients known
+// before the server restarted can still catch up.
+func loadQueues(opts *QueueOptions) (map[string]*queue, error) {
+	queues := make(map[string]*queue)
+	if opts.Dir == "" {
+		return queues, nil
+	}
+	entries, err := os.ReadDir(opts.Dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return queues, nil
+		}
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		id, err := url.PathUnescape(entry.Name())
+		if err != nil {
+			continue
+		}
+		q, err := newQueue(id, "", opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load queue %s: %v", id, err)
+		}
+		if q.name == "" {
+			// Queued by an old version, the client is identified by the
+			// name.
+			q.name = id
+		}
+		queues[id] = q
+	}
+	return queues, nil
+}
@@ -1,76 +1,72 @@
 package server
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
-	"sync"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/fioncat/wshare/config"
+	"github.com/fioncat/wshare/pkg/crypto"
 	"github.com/fioncat/wshare/pkg/log"
+	"github.com/fioncat/wshare/pkg/tlsutil"
 	"github.com/fioncat/wshare/share"
+	"github.com/fioncat/wshare/share/device"
+	"github.com/fioncat/wshare/share/transfer"
 	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
 )
 
-type Distributor struct {
-	mu sync.RWMutex
+// room is a room served, each room has its own distributor, so clients
+// only receive data from the same room.
+type room struct {
+	*share.Room
 
-	clients map[string]chan []byte
-}
+	distributor *Distributor
 
-func NewDistributor() *Distributor {
-	return &Distributor{
-		clients: make(map[string]chan []byte),
-	}
+	// pairing is nil if pairing is not enabled.
+	pairing *pairing
+
+	replay *transfer.ReplayWindow
 }
 
-func (d *Distributor) Register(name string) (string, <-chan []byte) {
-	d.mu.Lock()
-	defer d.mu.Unlock()
+// maxSessionKeys limits the keys a client can encrypt with in a session,
+// a client only has one, or a few when rotating the password. Deriving a
+// key for a new salt is expensive.
+const maxSessionKeys = 4
 
-	if _, ok := d.clients[name]; ok {
-		var idx = 1
-		for {
-			name = fmt.Sprintf("%s%d", name, idx)
-			if _, ok := d.clients[name]; !ok {
-				break
-			}
-			idx++
-		}
-	}
+var (
+	upgrader = websocket.Upgrader{}
+	rooms    map[string]*room
 
-	ch := make(chan []byte, 800)
-	d.clients[name] = ch
-	return name, ch
-}
+	maxFrameSize int64
 
-func (d *Distributor) Deregister(name string) {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-	ch := d.clients[name]
-	if ch == nil {
-		return
-	}
-	delete(d.clients, name)
-	close(ch)
-}
+	// serverName is added to the hops of the frames relayed.
+	serverName string
 
-func (d *Distributor) Notify(name string, data []byte) {
-	d.mu.RLock()
-	defer d.mu.RUnlock()
+	heartbeat *transfer.Heartbeat
+)
 
-	for target, notify := range d.clients {
-		if target != name {
-			notify <- data
-		}
+func handle(w http.ResponseWriter, r *http.Request) {
+	version, err := share.NegotiateVersion(r.Header.Get(share.HeaderProtocol))
+	if err != nil {
+		log.Get().Warnf("protocol negotiation failed for %s: %v", r.RemoteAddr, err)
+		http.Error(w, "protocol negotiation failed: "+err.Error(), http.StatusUpgradeRequired)
+		return
 	}
-}
 
-var (
-	upgrader    = websocket.Upgrader{}
-	distributor = NewDistributor()
-)
+	rm, d, err := authenticate(r)
+	if err != nil {
+		log.Get().Warnf("authentication failed for %s: %v", r.RemoteAddr, err)
+		http.Error(w, "authentication failed: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
 
-func handle(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	respHeader := http.Header{share.HeaderProtocol: []string{strconv.Itoa(version)}}
+	conn, err := upgrader.Upgrade(w, r, respHeader)
 	if err != nil {
 		log.Get().Errorf("failed to upgrade connection: %v", err)
 		return
@@ -79,53 +75,121 @@ func handle(w http.ResponseWriter, r *http.Request) {
 	addr := conn.RemoteAddr().String()
 
 	name := r.Header.Get("client-name")
+	queue := true
 	if name == "" {
 		log.Get().Warnf("client does not have a name, use remote addr")
 		name = addr
+		// The addr changes for each connection, no need to keep messages
+		// for it.
+		queue = false
+	}
+	id := clientID(r, d, name)
+	distributor := rm.distributor
+
+	stopHeartbeat := heartbeat.Start(conn, func() {
+		distributor.Touch(id, false)
+	})
+	defer stopHeartbeat()
+
+	if r.Header.Get(share.HeaderSendOnly) != "" {
+		// Only read the data to send, the client does not take the name
+		// of the registered client.
+		logger := log.Get().WithField("sender", name)
+		if rm.Name != "" {
+			logger = logger.WithField("room", rm.Name)
+		}
+		conn.SetReadLimit(maxFrameSize)
+		read(conn, logger, rm, id, name, func(data []byte) {
+			// No other goroutine writes to the connection.
+			conn.WriteMessage(websocket.BinaryMessage, data)
+		})
+		return
 	}
-	var notify <-chan []byte
-	name, notify = distributor.Register(name)
+
+	info := &share.Presence{
+		ID:       id,
+		Name:     name,
+		Version:  r.Header.Get(share.HeaderClientVersion),
+		Protocol: version,
+	}
+	if handlers := r.Header.Get(share.HeaderClientHandlers); handlers != "" {
+		info.Handlers = strings.Split(handlers, ",")
+	}
+	session, backlog := distributor.Register(info, queue)
 
 	logger := log.Get().WithField("client", name)
 	if name != addr {
 		logger = logger.WithField("addr", addr)
 	}
-	logger.Info("new client connected to server")
+	if rm.Name != "" {
+		logger = logger.WithField("room", rm.Name)
+	}
+	logger.WithField("id", id).Info("new client connected to server")
+
+	rm.announce(session.Presence())
+	defer func() {
+		p := distributor.Deregister(session)
+		if p != nil {
+			rm.announce(p)
+		}
+	}()
+
+	conn.SetReadLimit(maxFrameSize)
 
-	defer distributor.Deregister(name)
+	if len(backlog) > 0 {
+		logger.Infof("send %d messages queued while offline", len(backlog))
+	}
+	// Tell the client who are in the room.
+	for _, p := range distributor.Roster() {
+		if p.ID == id {
+			continue
+		}
+		data, err := presenceFrame(rm, p)
+		if err != nil {
+			logger.Errorf("failed to encode presence: %v", err)
+			continue
+		}
+		backlog = append(backlog, data)
+	}
+	for _, data := range backlog {
+		// The queued frames may be older than the clock skew, stamp them
+		// again so that the client accepts them.
+		data, err = restamp(rm, data)
+		if err != nil {
+			logger.Errorf("failed to stamp queued message: %v", err)
+			continue
+		}
+		err = conn.WriteMessage(websocket.BinaryMessage, data)
+		if err != nil {
+			logger.Errorf("failed to write queued message: %v", err)
+			return
+		}
+	}
 
 	done := make(chan struct{})
 	go func() {
 		defer close(done)
-		for {
-			mt, data, err := conn.ReadMessage()
-			if err != nil {
-				logger.Errorf("failed to read message from client: %v", err)
-				return
-			}
-			if mt != websocket.BinaryMessage {
-				continue
-			}
-
-			_, err = share.DecodePack(data)
-			if err != nil {
-				logger.Errorf("failed to decode packet: %v", err)
-				continue
-			}
-
-			size := log.BytesSize(data)
-			logger.Infof("recv %s data", size)
-			distributor.Notify(name, data)
-		}
+		read(conn, logger, rm, id, name, func(data []byte) {
+			distributor.Send(id, data)
+		})
+		// Break the write below if it is blocked by a dead connection.
+		conn.Close()
+		logger.Info("connection closed")
 	}()
 
 	for {
 		select {
 		case <-done:
-			logger.Info("connection closed")
 			return
 
-		case data := <-notify:
+		case <-session.Kicked():
+			reason := session.KickReason()
+			logger.Warnf("%s, disconnect it", reason)
+			msg := websocket.FormatCloseMessage(session.KickCode(), reason)
+			conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+			return
+
+		case data := <-session.C:
 			if conn == nil {
 				return
 			}
@@ -135,13 +199,255 @@ func handle(w http.ResponseWriter, r *http.Request) {
 				continue
 			}
 			size := log.BytesSize(data)
-			log.Get().Infof("send %s data", size)
+			logger.Debugf("send %s data", size)
+		}
+	}
+}
+
+// clientID returns the id of the client. The name is only a label, the
+// client is identified by the id, or by the device key if pairing is
+// enabled, so that a device cannot take over others. The clients before
+// the id is added are identified by the name. Only the hash of the id is
+// kept, see share.PresenceID.
+func clientID(r *http.Request, d *device.Device, name string) string {
+	id := r.Header.Get(share.HeaderClientID)
+	if d != nil {
+		id = d.Fingerprint()
+	}
+	if id == "" {
+		id = name
+	}
+	return share.PresenceID(id)
+}
+
+// handlePresence lists the clients of the room, see Distributor.Roster.
+func handlePresence(w http.ResponseWriter, r *http.Request) {
+	rm, d, err := authenticate(r)
+	if err != nil {
+		log.Get().Warnf("authentication failed for %s: %v", r.RemoteAddr, err)
+		http.Error(w, "authentication failed: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+	id := clientID(r, d, r.Header.Get("client-name"))
+	roster := rm.distributor.Roster()
+	for _, p := range roster {
+		p.Self = p.ID == id
+	}
+	writeJSON(w, roster)
+}
+
+// read reads the frames from the client, and sends them to the other
+// clients in the room, until the connection is closed. The acks are sent
+// back to the client by reply.
+func read(conn *websocket.Conn, logger *logrus.Entry, rm *room, id, name string, reply func([]byte)) {
+	// keys is the keys the client encrypts with, see maxSessionKeys.
+	keys := make(map[string]struct{})
+	for {
+		mt, data, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if transfer.IsTimeout(err) {
+				logger.Warnf("no heartbeat from client in %v, disconnect it", heartbeat.Timeout)
+				return
+			}
+			logger.Errorf("failed to read message from client: %v", err)
+			return
+		}
+		heartbeat.Alive(conn)
+		rm.distributor.Touch(id, true)
+		if mt != websocket.BinaryMessage {
+			continue
+		}
+
+		keyHeader, err := crypto.KeyHeader(data)
+		if err != nil {
+			logger.Errorf("failed to decode frame: %v", err)
+			continue
+		}
+		if _, ok := keys[keyHeader]; !ok {
+			if len(keys) >= maxSessionKeys {
+				logger.Warnf("reject frame, the client encrypts with more than %d keys", maxSessionKeys)
+				continue
+			}
+			keys[keyHeader] = struct{}{}
+		}
+		frame, err := share.DecodeFrame(rm.Key, data)
+		if err != nil {
+			logger.Errorf("failed to decode frame: %v", err)
+			continue
+		}
+		err = rm.replay.Check(frame)
+		if err != nil {
+			logger.Warnf("reject frame: %v", err)
+			continue
+		}
+
+		frame.Stamp(name, serverName)
+		data, err = frame.Encode(rm.Key)
+		if err != nil {
+			logger.Errorf("failed to stamp frame: %v", err)
+			continue
+		}
+
+		last := frame.Kind == share.FrameChunk && frame.Index == frame.Total-1
+		if last {
+			size := log.Size(frame.Size)
+			if len(frame.To) > 0 {
+				logger.Infof("recv %s data in %d frames, to %s", size, frame.Total, strings.Join(frame.To, ","))
+			} else {
+				logger.Infof("recv %s data in %d frames", size, frame.Total)
+			}
+		}
+		var transferID string
+		if frame.Kind == share.FrameChunk {
+			transferID = frame.ID
+		}
+		targets := rm.distributor.Notify(id, data, transferID, frame.To)
+		if !last {
+			continue
+		}
+
+		ack := &share.Frame{
+			Kind: share.FrameAck,
+			ID:   frame.ID,
+			To:   targets,
 		}
+		data, err = ack.Encode(rm.Key)
+		if err != nil {
+			logger.Errorf("failed to encode ack: %v", err)
+			continue
+		}
+		reply(data)
+	}
+}
+
+// announce tells the other clients that a client joins or leaves.
+func (rm *room) announce(p *share.Presence) {
+	data, err := presenceFrame(rm, p)
+	if err != nil {
+		log.Get().Errorf("failed to encode presence: %v", err)
+		return
+	}
+	rm.distributor.Broadcast(p.ID, data)
+}
+
+func presenceFrame(rm *room, p *share.Presence) ([]byte, error) {
+	data, err := p.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	frame := &share.Frame{
+		Kind: share.FramePresence,
+		Data: data,
+	}
+	return frame.Encode(rm.Key)
+}
+
+func restamp(rm *room, data []byte) ([]byte, error) {
+	frame, err := share.DecodeFrame(rm.Key, data)
+	if err != nil {
+		return nil, err
 	}
+	return frame.Encode(rm.Key)
 }
 
 func Start(addr string) error {
+	chunkSize, err := transfer.ChunkSize()
+	if err != nil {
+		return err
+	}
+	maxFrameSize = transfer.MaxFrameSize(chunkSize)
+
+	serverName = config.Get().Name
+	if serverName == "" {
+		serverName = "server"
+	}
+
+	skew, err := transfer.ClockSkew()
+	if err != nil {
+		return err
+	}
+	heartbeat, err = transfer.LoadHeartbeat()
+	if err != nil {
+		return err
+	}
+
+	queueOpts, err := LoadQueueOptions()
+	if err != nil {
+		return err
+	}
+	fanoutOpts, err := LoadFanoutOptions()
+	if err != nil {
+		return err
+	}
+	shareRooms, err := share.ServerRooms()
+	if err != nil {
+		return err
+	}
+	rooms = make(map[string]*room, len(shareRooms))
+	for _, shareRoom := range shareRooms {
+		roomQueueOpts, err := queueOpts.forRoom(shareRoom.Name)
+		if err != nil {
+			return fmt.Errorf("failed to init queue for room %s: %v", shareRoom.DisplayName(), err)
+		}
+		distributor, err := NewDistributor(roomQueueOpts, fanoutOpts)
+		if err != nil {
+			return fmt.Errorf("failed to init distributor for room %s: %v", shareRoom.DisplayName(), err)
+		}
+		rm := &room{
+			Room:        shareRoom,
+			distributor: distributor,
+			replay:      transfer.NewReplayWindow(skew, skew),
+		}
+		if config.Get().Pairing {
+			rm.pairing, err = newPairing(shareRoom.Name)
+			if err != nil {
+				return fmt.Errorf("failed to init pairing for room %s: %v", shareRoom.DisplayName(), err)
+			}
+		}
+		rooms[shareRoom.Name] = rm
+	}
+	if len(rooms) > 1 {
+		log.Get().Infof("serve %d rooms", len(rooms))
+	}
+
+	go expireQueues()
+
 	log.Get().Infof("server start listen on %s", addr)
+	http.HandleFunc(share.ChallengePath, handleChallenge)
 	http.HandleFunc("/share", handle)
+	http.HandleFunc(share.PathPresence, handlePresence)
+	if config.Get().Pairing {
+		log.Get().Info("pairing is enabled")
+		http.HandleFunc(device.PathRequest, handlePairRequest)
+		http.HandleFunc(device.PathStatus, handlePairStatus)
+		http.HandleFunc(device.PathPending, handlePairPending)
+		http.HandleFunc(device.PathApprove, handlePairApprove)
+		http.HandleFunc(device.PathList, handlePairList)
+		http.HandleFunc(device.PathRemove, handlePairRemove)
+	}
+
+	tlsCfg := config.Get().TLS
+	if tlsCfg.Enable {
+		srv := &http.Server{Addr: addr}
+		srv.TLSConfig, err = tlsutil.ServerConfig(tlsCfg)
+		if err != nil {
+			return err
+		}
+		log.Get().Info("tls is enabled")
+		return srv.ListenAndServeTLS("", "")
+	}
 	return http.ListenAndServe(addr, nil)
 }
+
+// expireQueues removes the queues of the clients gone, see
+// Distributor.ExpireQueues.
+func expireQueues() {
+	for range time.Tick(queueExpireInterval) {
+		for _, rm := range rooms {
+			rm.distributor.ExpireQueues()
+		}
+	}
+}
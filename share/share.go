@@ -2,9 +2,13 @@ package share
 
 import (
 	"bytes"
-	"encoding/gob"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,6 +16,7 @@ import (
 	"github.com/fioncat/wshare/pkg/crypto"
 	"github.com/fioncat/wshare/pkg/log"
 	"github.com/fioncat/wshare/pkg/osutil"
+	"github.com/fioncat/wshare/pkg/wire"
 	"github.com/sirupsen/logrus"
 )
 
@@ -21,37 +26,339 @@ type Packet struct {
 	Metadata []byte
 
 	Data []byte
+
+	// To is the names of the clients to deliver to, empty means all the
+	// other clients.
+	To []string
 }
 
-func (p *Packet) Encode() ([]byte, error) {
-	var buff bytes.Buffer
-	encoder := gob.NewEncoder(&buff)
-	err := encoder.Encode(p)
+// Payload is an encoded packet, see Packet.Encode.
+type Payload struct {
+	Data []byte
+
+	// Flags should be set to the frames of the payload, see Frame.Flags.
+	Flags uint8
+
+	// Size is the size before compressing.
+	Size int
+}
+
+// Encode encodes the packet into a payload. The payload is split into
+// frames and each frame is encrypted by the room key when sending. If the
+// packet is larger than compressThreshold, it is compressed first. If e
+// is not nil, the payload is also encrypted end-to-end.
+func (p *Packet) Encode(e *E2E, compressThreshold int) (*Payload, error) {
+	data := p.marshal()
+	size := len(data)
+	data, flags := p.compress(data, compressThreshold)
+	if e == nil {
+		return &Payload{Data: data, Flags: flags, Size: size}, nil
+	}
+
+	sealed, err := e.seal(data, p.To)
+	if err != nil {
+		return nil, err
+	}
+	data, err = sealed.MarshalBinary()
 	if err != nil {
 		return nil, err
 	}
+	var enc wire.Encoder
+	enc.Raw(packetSealed, data)
+	return &Payload{Data: enc.Bytes(), Flags: flags, Size: size}, nil
+}
+
+// DecodePack decodes the payload encoded by Packet.Encode, flags is from
+// the frames, maxSize limits the decompressed packet. If e is not nil, the
+// payload must be encrypted end-to-end, the sender is verified and
+// returned.
+func DecodePack(r io.Reader, flags uint8, maxSize int64, e *E2E) (*Packet, *Sender, error) {
+	if e == nil {
+		r, err := decompress(r, flags, maxSize)
+		if err != nil {
+			return nil, nil, err
+		}
+		p, sealed, err := decodePayload(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decode packet: %v", err)
+		}
+		if sealed != nil {
+			return nil, nil, errors.New("packet is encrypted end-to-end, please enable e2e")
+		}
+		return p, nil, nil
+	}
+
+	_, sealed, err := decodePayload(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode packet: %v", err)
+	}
+	if sealed == nil {
+		return nil, nil, errors.New("packet is not encrypted end-to-end, please enable e2e on the sender")
+	}
+	data, sender, err := e.open(sealed)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err = decompress(bytes.NewReader(data), flags, maxSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	p, sealed, err := decodePayload(r)
+	if err != nil || sealed != nil {
+		return nil, nil, fmt.Errorf("failed to decode sealed packet: %v", err)
+	}
+	return p, sender, nil
+}
+
+type FrameKind string
+
+const (
+	// FrameChunk carries a part of a payload.
+	FrameChunk FrameKind = "chunk"
+
+	// FrameResume is sent by a receiver to tell the sender which chunks
+	// of a transfer it already has, the sender sends the rest.
+	FrameResume FrameKind = "resume"
+
+	// FrameQuery is sent by a sender after reconnecting, to ask receivers
+	// to reply FrameResume for a transfer.
+	FrameQuery FrameKind = "query"
+
+	// FrameAck is sent by the server to the sender when it receives the
+	// last chunk of a transfer, To is the clients it is delivered to
+	// (or queued for).
+	FrameAck FrameKind = "ack"
+
+	// FrameReceipt is sent by a receiver to the sender of a transfer,
+	// after the packet is handled. Error is set if the handler fails.
+	FrameReceipt FrameKind = "receipt"
+
+	// FramePresence is sent by the server when a client joins or leaves
+	// the room, Data is the encoded Presence.
+	FramePresence FrameKind = "presence"
+)
+
+// Frame is the unit sent over the websocket. An encoded packet is split
+// into one or more frames, so that neither the server nor the clients
+// need to hold a whole payload in a single message.
+type Frame struct {
+	Kind FrameKind
+
+	// ID identifies the transfer that the frame belongs to.
+	ID string
+
+	Index int
+	Total int
+
+	// Offset is the position of Data in the payload.
+	Offset int64
+
+	// Size and Hash describe the whole payload, the receiver uses them
+	// to check the reassembled payload.
+	Size int64
+	Hash string
+
+	Data []byte
+
+	// Received is the chunk indexes the receiver has, for FrameResume.
+	Received []int
+
+	// To is copied from Packet.To, the server only delivers the frame to
+	// these clients.
+	To []string
+
+	// From is the name of the sender, the receivers send receipts to it.
+	// It is set by the server, see Stamp.
+	From string
+
+	// Sent is the time (unix nanoseconds) the sender sent the frame, and
+	// Hops is the servers relaying it, they are set by the server.
+	Sent int64
+	Hops []Hop
+
+	// Error is the error of handling the packet, for FrameReceipt.
+	Error string
+
+	// Flags describes the payload, such as FlagGzip. It is carried in the
+	// envelope header, not in the encoded fields.
+	Flags uint8
+
+	// Time (unix nanoseconds) and MessageID are stamped by Encode, inside
+	// the encrypted data, so that the receivers can reject replayed and
+	// stale frames, see transfer.ReplayWindow.
+	Time      int64
+	MessageID string
+}
+
+// Encode stamps the frame with the current time and a new message ID, then
+// encodes and encrypts it.
+func (f *Frame) Encode(key *crypto.Key) ([]byte, error) {
+	messageID := make([]byte, 16)
+	_, err := rand.Read(messageID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate message id: %v", err)
+	}
+	f.Time = time.Now().UnixNano()
+	f.MessageID = hex.EncodeToString(messageID)
 
-	data := buff.Bytes()
-	return crypto.Encrypt(data), nil
+	return key.EncryptFlags(f.marshal(), f.Flags), nil
 }
 
-func DecodePack(data []byte) (*Packet, error) {
-	data, err := crypto.Decrypt(data)
+func DecodeFrame(key *crypto.Key, data []byte) (*Frame, error) {
+	data, flags, err := key.DecryptFlags(data)
 	if err != nil {
 		return nil, fmt.Errorf("decrypt data failed: %v", err)
 	}
+	f, err := unmarshalFrame(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode frame: %v", err)
+	}
+	f.Flags = flags
+	return f, nil
+}
 
-	var buff bytes.Buffer
-	buff.Write(data)
-	decoder := gob.NewDecoder(&buff)
+// The headers used in the authentication handshake. Before dialing the
+// websocket, the client gets a one-time nonce and the key derivation
+// parameters of the room from the challenge path, and sends the nonce and
+// its MAC (see AuthMessage) in these headers.
+const (
+	ChallengePath = "/challenge"
+
+	HeaderAuthNonce = "Auth-Nonce"
+	HeaderAuthMAC   = "Auth-Mac"
+
+	// HeaderAuthKDF is the crypto header of the MAC key (see
+	// crypto.Key.AuthMAC), it has the parameters of the server and the key
+	// id of the client.
+	HeaderAuthKDF = "Auth-Kdf"
+
+	// HeaderRoom is the room to join, empty for the default room.
+	HeaderRoom = "Client-Room"
+
+	// HeaderClientID is the persistent id of the client, see LoadClientID.
+	// A new connection with the same id takes over the old one.
+	HeaderClientID = "Client-Id"
 
-	var p Packet
-	err = decoder.Decode(&p)
+	// When pairing is enabled, the client also sends its public key and
+	// the signature of SignMessage.
+	HeaderAuthDevice    = "Auth-Device"
+	HeaderAuthSignature = "Auth-Signature"
+
+	// The box key of the device and its signature, for end-to-end
+	// encryption.
+	HeaderAuthBoxKey    = "Auth-Box-Key"
+	HeaderAuthBoxKeySig = "Auth-Box-Key-Sig"
+
+	// HeaderSendOnly tells the server that the client only sends data,
+	// such as "wshared send", so it is not registered to receive data.
+	HeaderSendOnly = "Client-Send-Only"
+
+	// HeaderProtocol negotiates the protocol version: the client sends the
+	// versions it supports, the server replies the version chosen, see
+	// NegotiateVersion.
+	HeaderProtocol = "Wshare-Protocol"
+)
+
+// CloseReplaced is the websocket close code sent to a client, when it is
+// taken over by a new connection with the same id. The client should not
+// reconnect automatically, or two clients with the same id would keep
+// replacing each other.
+const CloseReplaced = 4001
+
+// LoadClientID returns the persistent id of this client, it is generated
+// at the first time.
+func LoadClientID() (string, error) {
+	path, err := config.LocalFile("client.id")
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode packet: %v", err)
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
 	}
+	if !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read client id: %v", err)
+	}
+	buf := make([]byte, 16)
+	_, err = rand.Read(buf)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate client id: %v", err)
+	}
+	id := hex.EncodeToString(buf)
+	err = os.WriteFile(path, []byte(id+"\n"), 0600)
+	if err != nil {
+		return "", fmt.Errorf("failed to save client id: %v", err)
+	}
+	return id, nil
+}
 
-	return &p, nil
+// AuthMessage returns the message to MAC in the authentication handshake,
+// id is the client id (see HeaderClientID), it is bound to the nonce.
+func AuthMessage(nonce, room, name, id string) []byte {
+	return []byte("wshare-auth\n" + nonce + "\n" + room + "\n" + name + "\n" + id)
+}
+
+// SignMessage returns the message for the device to sign in the
+// authentication handshake, uri is the requested uri.
+func SignMessage(nonce, room, name, id, uri string) []byte {
+	return []byte("wshare-sign\n" + nonce + "\n" + room + "\n" + name + "\n" + id + "\n" + uri)
+}
+
+// Room is a group of clients sharing data with each other. Each room has
+// its own password, so rooms on the same server cannot see each other's
+// data. The default room has an empty name and uses the global password.
+type Room struct {
+	Name string
+	Key  *crypto.Key
+}
+
+// ClientRooms returns the rooms to join. If no room is configured, the
+// client joins the default room.
+func ClientRooms() ([]*Room, error) {
+	cfgs := config.Get().Rooms
+	if len(cfgs) == 0 {
+		return []*Room{{Key: crypto.Default()}}, nil
+	}
+	return newRooms(cfgs)
+}
+
+// ServerRooms returns the rooms to serve, the default room is always
+// served.
+func ServerRooms() ([]*Room, error) {
+	rooms, err := newRooms(config.Get().Rooms)
+	if err != nil {
+		return nil, err
+	}
+	return append([]*Room{{Key: crypto.Default()}}, rooms...), nil
+}
+
+func newRooms(cfgs []*config.Room) ([]*Room, error) {
+	rooms := make([]*Room, 0, len(cfgs))
+	names := make(map[string]struct{}, len(cfgs))
+	for _, cfg := range cfgs {
+		if _, ok := names[cfg.Name]; ok {
+			return nil, fmt.Errorf("duplicate room %q", cfg.Name)
+		}
+		names[cfg.Name] = struct{}{}
+		secrets, err := crypto.Secrets(cfg.Password, cfg.KeyID, cfg.Keys)
+		if err != nil {
+			return nil, fmt.Errorf("invalid keys for room %q: %v", cfg.Name, err)
+		}
+		key, err := crypto.NewKeySet(secrets, crypto.Default().Params())
+		if err != nil {
+			return nil, fmt.Errorf("failed to init key for room %q: %v", cfg.Name, err)
+		}
+		rooms = append(rooms, &Room{Name: cfg.Name, Key: key})
+	}
+	return rooms, nil
+}
+
+// DisplayName returns the name of the room for logging.
+func (r *Room) DisplayName() string {
+	if r.Name == "" {
+		return "default"
+	}
+	return r.Name
 }
 
 type History struct {
@@ -95,6 +402,13 @@ type Context struct {
 
 	History *History
 	Pack    *Packet
+
+	// Sender is the verified sender of the packet, nil if end-to-end
+	// encryption is not enabled.
+	Sender *Sender
+
+	// Origin is the sender and the route stamped by the server.
+	Origin *Origin
 }
 
 type Handler interface {
@@ -0,0 +1,104 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fioncat/wshare/config"
+	"github.com/gorilla/websocket"
+)
+
+// Heartbeat detects dead connections. A half-open connection, such as
+// after a laptop sleeps, looks connected while nothing flows, so both the
+// server and the clients ping the other side every Interval, and a read
+// fails when nothing is received within Timeout.
+type Heartbeat struct {
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// LoadHeartbeat returns the configured heartbeat.
+func LoadHeartbeat() (*Heartbeat, error) {
+	cfg := config.Get().Heartbeat
+	interval, err := time.ParseDuration(cfg.Interval)
+	if err != nil {
+		return nil, fmt.Errorf("invalid heartbeat interval %q: %v", cfg.Interval, err)
+	}
+	timeout, err := time.ParseDuration(cfg.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid heartbeat timeout %q: %v", cfg.Timeout, err)
+	}
+	if interval <= 0 {
+		return nil, errors.New("heartbeat interval must be positive")
+	}
+	if timeout <= interval {
+		return nil, errors.New("heartbeat timeout must be longer than the interval")
+	}
+	return &Heartbeat{Interval: interval, Timeout: timeout}, nil
+}
+
+// Start pings the other side until stop is called or the connection is
+// broken. The read deadline of conn is extended by each ping and pong
+// received, and seen is called if not nil. The caller should also call
+// Alive for each message.
+func (h *Heartbeat) Start(conn *websocket.Conn, seen func()) (stop func()) {
+	h.Alive(conn)
+	conn.SetPongHandler(func(string) error {
+		h.Alive(conn)
+		if seen != nil {
+			seen()
+		}
+		return nil
+	})
+	conn.SetPingHandler(func(data string) error {
+		h.Alive(conn)
+		if seen != nil {
+			seen()
+		}
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(h.Timeout))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
+	})
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(h.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+
+			case <-ticker.C:
+				// WriteControl can be called concurrently with the other
+				// writes.
+				err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(h.Timeout))
+				if err != nil {
+					// The read deadline will break the connection.
+					return
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// Alive extends the read deadline of conn.
+func (h *Heartbeat) Alive(conn *websocket.Conn) {
+	conn.SetReadDeadline(time.Now().Add(h.Timeout))
+}
+
+// IsTimeout reports whether err is caused by no heartbeat.
+func IsTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,210 @@
+package transfer
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fioncat/wshare/share"
+)
+
+const (
+	// outboundTTL is how long a sent transfer is kept to serve resume
+	// requests.
+	outboundTTL = time.Minute * 10
+
+	// outboundMaxBytes is the max size of the chunks kept, the oldest
+	// transfers are dropped first. A transfer larger than this is not kept
+	// for resume once it is sent.
+	outboundMaxBytes = 64 << 20
+)
+
+type outbound struct {
+	frames []*share.Frame
+	size   int
+
+	// sent is the number of frames written to the connection.
+	sent int
+
+	// waiting is the recipients not sending receipts yet, nil before the
+	// ack from the server.
+	waiting map[string]struct{}
+
+	created time.Time
+}
+
+// Outbox keeps the transfers sent recently, so that after reconnecting,
+// the unsent frames can be sent, and the frames lost can be resent when
+// receivers ask for them. A transfer is dropped when all the recipients
+// send receipts.
+type Outbox struct {
+	mu sync.Mutex
+
+	outbounds map[string]*outbound
+	size      int
+	max       int
+}
+
+func NewOutbox() *Outbox {
+	return &Outbox{
+		outbounds: make(map[string]*outbound),
+		max:       outboundMaxBytes,
+	}
+}
+
+// Add adds the frames of a new transfer, the frames must be returned by
+// Split.
+func (o *Outbox) Add(frames []*share.Frame) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	out := &outbound{
+		frames:  frames,
+		created: time.Now(),
+	}
+	for _, f := range frames {
+		out.size += len(f.Data)
+	}
+	o.outbounds[frames[0].ID] = out
+	o.size += out.size
+	o.clean()
+}
+
+// Acked records the recipients of a transfer, see share.FrameAck.
+func (o *Outbox) Acked(ack *share.Frame) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	out := o.outbounds[ack.ID]
+	if out == nil {
+		return
+	}
+	out.waiting = make(map[string]struct{}, len(ack.To))
+	for _, name := range ack.To {
+		out.waiting[name] = struct{}{}
+	}
+	if len(out.waiting) == 0 {
+		o.remove(ack.ID)
+	}
+}
+
+// Receipt records the receipt of a recipient, the transfer is dropped
+// when all the recipients have sent receipts.
+func (o *Outbox) Receipt(receipt *share.Frame) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	out := o.outbounds[receipt.ID]
+	if out == nil || out.waiting == nil {
+		return
+	}
+	delete(out.waiting, receipt.From)
+	if len(out.waiting) == 0 {
+		o.remove(receipt.ID)
+	}
+}
+
+// Sent marks a frame as written to the connection.
+func (o *Outbox) Sent(f *share.Frame) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	out := o.outbounds[f.ID]
+	if out != nil && f.Index >= out.sent {
+		out.sent = f.Index + 1
+		if out.sent == len(out.frames) {
+			o.clean()
+		}
+	}
+}
+
+// Unsent returns the frames that have not been written for each transfer
+// interrupted by a disconnection.
+func (o *Outbox) Unsent() map[string][]*share.Frame {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.clean()
+	unsent := make(map[string][]*share.Frame)
+	for id, out := range o.outbounds {
+		if out.sent < len(out.frames) {
+			unsent[id] = out.frames[out.sent:]
+		}
+	}
+	return unsent
+}
+
+// Query returns the FrameQuery of a transfer, to the recipients of it.
+func (o *Outbox) Query(id string) *share.Frame {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	f := &share.Frame{
+		Kind: share.FrameQuery,
+		ID:   id,
+	}
+	if out := o.outbounds[id]; out != nil {
+		f.To = out.frames[0].To
+	}
+	return f
+}
+
+// Missing returns the frames missed by a receiver according to its
+// FrameResume. If the transfer is unknown or expired, returns nil.
+func (o *Outbox) Missing(resume *share.Frame) []*share.Frame {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	out := o.outbounds[resume.ID]
+	if out == nil {
+		return nil
+	}
+	received := make(map[int]struct{}, len(resume.Received))
+	for _, idx := range resume.Received {
+		received[idx] = struct{}{}
+	}
+	var missing []*share.Frame
+	for _, f := range out.frames {
+		if _, ok := received[f.Index]; !ok {
+			missing = append(missing, f)
+		}
+	}
+	return missing
+}
+
+func (o *Outbox) remove(id string) {
+	if out := o.outbounds[id]; out != nil {
+		o.size -= out.size
+		delete(o.outbounds, id)
+	}
+}
+
+// clean drops the expired transfers, and the oldest ones if the size
+// exceeds the limit. The transfers being sent are kept, the caller holds
+// their frames anyway. The caller must hold the lock.
+func (o *Outbox) clean() {
+	now := time.Now()
+	for id, out := range o.outbounds {
+		if now.Sub(out.created) >= outboundTTL {
+			o.remove(id)
+		}
+	}
+	if o.size <= o.max {
+		return
+	}
+	ids := make([]string, 0, len(o.outbounds))
+	for id, out := range o.outbounds {
+		if out.sent == len(out.frames) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return o.outbounds[ids[i]].created.Before(o.outbounds[ids[j]].created)
+	})
+	for _, id := range ids {
+		if o.size <= o.max {
+			return
+		}
+		o.remove(id)
+	}
+}
@@ -0,0 +1,281 @@
+package transfer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fioncat/wshare/pkg/osutil"
+	"github.com/fioncat/wshare/share"
+)
+
+const (
+	// inboundTTL is how long an incomplete transfer is kept without
+	// receiving any new frame.
+	inboundTTL = time.Minute * 10
+
+	// maxInboundPerSender limits the incomplete transfers of a sender, so
+	// that a sender cannot make us keep too many temp files.
+	maxInboundPerSender = 16
+)
+
+type inbound struct {
+	file *os.File
+
+	// from is the sender, the FrameResume is sent to it.
+	from string
+
+	size int64
+	hash string
+
+	received []bool
+	count    int
+
+	updated time.Time
+}
+
+func (in *inbound) close() {
+	in.file.Close()
+	os.Remove(in.file.Name())
+}
+
+// Receiver reassembles frames into payloads. Payloads with more than one
+// frame are written to a temp file, so the memory used does not depend on
+// the payload size.
+type Receiver struct {
+	mu sync.Mutex
+
+	// chunkSize is the chunk size of the senders, see Split. maxSize is
+	// the max size of a payload.
+	chunkSize int
+	maxSize   int64
+
+	inbounds map[string]*inbound
+
+	// completed records the transfers done recently, frames resent for
+	// them are ignored.
+	completed map[string]time.Time
+
+	lastClean time.Time
+}
+
+func NewReceiver(chunkSize int, maxSize int64) *Receiver {
+	return &Receiver{
+		chunkSize: chunkSize,
+		maxSize:   maxSize,
+		inbounds:  make(map[string]*inbound),
+		completed: make(map[string]time.Time),
+		lastClean: time.Now(),
+	}
+}
+
+// Add adds a frame. When the transfer is complete, a reader of the whole
+// payload is returned, the caller must close it. Otherwise, nil is
+// returned.
+func (r *Receiver) Add(f *share.Frame) (io.ReadCloser, error) {
+	err := r.check(f)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clean()
+
+	if _, ok := r.completed[f.ID]; ok {
+		return nil, nil
+	}
+	if f.Total == 1 {
+		if osutil.Sum(f.Data) != f.Hash {
+			return nil, errors.New("payload hash mismatch")
+		}
+		r.completed[f.ID] = time.Now()
+		return io.NopCloser(bytes.NewReader(f.Data)), nil
+	}
+
+	in := r.inbounds[f.ID]
+	if in == nil {
+		if r.countFrom(f.From) >= maxInboundPerSender {
+			return nil, fmt.Errorf("too many incomplete transfers from %q", f.From)
+		}
+		file, err := os.CreateTemp("", "wshare-transfer-*")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create temp file: %v", err)
+		}
+		in = &inbound{
+			file:     file,
+			from:     f.From,
+			size:     f.Size,
+			hash:     f.Hash,
+			received: make([]bool, f.Total),
+		}
+		r.inbounds[f.ID] = in
+	}
+	if in.size != f.Size || in.hash != f.Hash || len(in.received) != f.Total {
+		return nil, fmt.Errorf("frame does not match transfer %s", f.ID)
+	}
+	in.updated = time.Now()
+	if in.received[f.Index] {
+		return nil, nil
+	}
+
+	_, err = in.file.WriteAt(f.Data, f.Offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write temp file: %v", err)
+	}
+	in.received[f.Index] = true
+	in.count++
+	if in.count < len(in.received) {
+		return nil, nil
+	}
+
+	delete(r.inbounds, f.ID)
+	r.completed[f.ID] = time.Now()
+	return in.finish()
+}
+
+// check checks that the frame is a chunk split by Split with our chunk
+// size, and the payload is not too large.
+func (r *Receiver) check(f *share.Frame) error {
+	if f.Size < 0 || f.Size > r.maxSize {
+		return fmt.Errorf("payload size %d exceeds the limit %d", f.Size, r.maxSize)
+	}
+	total := int((f.Size + int64(r.chunkSize) - 1) / int64(r.chunkSize))
+	if total == 0 {
+		total = 1
+	}
+	if f.Total != total {
+		return fmt.Errorf("invalid frame total %d for size %d, the chunk size of the sender may "+
+			"be different, please keep it the same on all machines", f.Total, f.Size)
+	}
+	if f.Index < 0 || f.Index >= f.Total {
+		return fmt.Errorf("invalid frame index %d/%d", f.Index, f.Total)
+	}
+	offset := int64(f.Index) * int64(r.chunkSize)
+	end := offset + int64(r.chunkSize)
+	if end > f.Size {
+		end = f.Size
+	}
+	if f.Offset != offset || int64(len(f.Data)) != end-offset {
+		return fmt.Errorf("invalid frame offset %d", f.Offset)
+	}
+	return nil
+}
+
+// countFrom returns the number of incomplete transfers from the sender.
+// The caller must hold the lock.
+func (r *Receiver) countFrom(from string) int {
+	var count int
+	for _, in := range r.inbounds {
+		if in.from == from {
+			count++
+		}
+	}
+	return count
+}
+
+// Resume returns the FrameResume to reply a FrameQuery, to the sender of
+// the query. If the transfer is completed or unknown, returns nil: the
+// sender sends the frames not written anyway, and a transfer we have not
+// received anything of may not be for us.
+func (r *Receiver) Resume(query *share.Frame) *share.Frame {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	in := r.inbounds[query.ID]
+	if in == nil {
+		return nil
+	}
+	return in.resume(query.ID, query.From)
+}
+
+// Resumes returns FrameResume for all incomplete transfers, they are sent
+// after reconnecting, so senders can send chunks we missed.
+func (r *Receiver) Resumes() []*share.Frame {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	frames := make([]*share.Frame, 0, len(r.inbounds))
+	for id, in := range r.inbounds {
+		frames = append(frames, in.resume(id, in.from))
+	}
+	return frames
+}
+
+func (in *inbound) resume(id, to string) *share.Frame {
+	f := &share.Frame{
+		Kind:     share.FrameResume,
+		ID:       id,
+		Received: in.receivedIndexes(),
+	}
+	if to != "" {
+		f.To = []string{to}
+	}
+	return f
+}
+
+func (in *inbound) receivedIndexes() []int {
+	idxs := make([]int, 0, in.count)
+	for idx, ok := range in.received {
+		if ok {
+			idxs = append(idxs, idx)
+		}
+	}
+	return idxs
+}
+
+func (in *inbound) finish() (io.ReadCloser, error) {
+	hash, err := osutil.SumFile(in.file.Name())
+	if err != nil {
+		in.close()
+		return nil, fmt.Errorf("failed to sum payload: %v", err)
+	}
+	if hash != in.hash {
+		in.close()
+		return nil, errors.New("payload hash mismatch")
+	}
+	_, err = in.file.Seek(0, io.SeekStart)
+	if err != nil {
+		in.close()
+		return nil, err
+	}
+	return &tempReader{in: in}, nil
+}
+
+type tempReader struct {
+	in *inbound
+}
+
+func (r *tempReader) Read(p []byte) (int, error) {
+	return r.in.file.Read(p)
+}
+
+func (r *tempReader) Close() error {
+	r.in.close()
+	return nil
+}
+
+// clean removes transfers that have not been updated for a long time.
+// The caller must hold the lock.
+func (r *Receiver) clean() {
+	now := time.Now()
+	if now.Sub(r.lastClean) < time.Minute {
+		return
+	}
+	r.lastClean = now
+	for id, in := range r.inbounds {
+		if now.Sub(in.updated) >= inboundTTL {
+			in.close()
+			delete(r.inbounds, id)
+		}
+	}
+	for id, done := range r.completed {
+		if now.Sub(done) >= inboundTTL {
+			delete(r.completed, id)
+		}
+	}
+}
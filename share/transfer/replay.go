@@ -0,0 +1,159 @@
+package transfer
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fioncat/wshare/config"
+	"github.com/fioncat/wshare/share"
+)
+
+// maxReplayIDs limits the message ids remembered per sender by a
+// ReplayWindow.
+const maxReplayIDs = 100000
+
+// ClockSkew returns the configured clock skew.
+func ClockSkew() (time.Duration, error) {
+	str := config.Get().Transfer.ClockSkew
+	skew, err := time.ParseDuration(str)
+	if err != nil {
+		return 0, fmt.Errorf("invalid clock skew %q: %v", str, err)
+	}
+	if skew <= 0 {
+		return 0, errors.New("clock skew must be positive")
+	}
+	return skew, nil
+}
+
+// SealedMaxAge returns how old a sealed packet can be. Unlike the frames,
+// they are not stamped again by the server, and can be queued for offline
+// clients up to the queue ttl.
+func SealedMaxAge(skew time.Duration) (time.Duration, error) {
+	str := config.Get().Queue.TTL
+	ttl, err := time.ParseDuration(str)
+	if err != nil {
+		return 0, fmt.Errorf("invalid queue ttl %q: %v", str, err)
+	}
+	return skew + ttl, nil
+}
+
+// ReplayWindow rejects the frames seen before, and the frames whose time
+// is out of the window. The message ids are remembered per sender until
+// they are out of the window, then the frames are rejected as stale anyway.
+// When a sender has too many ids, the oldest are forgotten and the frames
+// not newer than them are rejected, so a busy sender does not block the
+// others, and forgetting never lets a replay through.
+type ReplayWindow struct {
+	// maxAge is how old a frame can be, skew is how far it can be in the
+	// future.
+	maxAge time.Duration
+	skew   time.Duration
+	max    int
+
+	mu      sync.Mutex
+	senders map[string]*replaySender
+}
+
+type replaySender struct {
+	// seen maps message ids to the time they were sent, order has the same
+	// ids, oldest first.
+	seen  map[string]time.Time
+	order replayHeap
+
+	// floor is the send time of the newest id forgotten before expiring.
+	floor time.Time
+}
+
+type replayID struct {
+	id   string
+	sent time.Time
+}
+
+type replayHeap []replayID
+
+func (h replayHeap) Len() int            { return len(h) }
+func (h replayHeap) Less(i, j int) bool  { return h[i].sent.Before(h[j].sent) }
+func (h replayHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *replayHeap) Push(x interface{}) { *h = append(*h, x.(replayID)) }
+func (h *replayHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// NewReplayWindow creates a window accepting frames sent in maxAge, and
+// in skew in the future. maxAge is more than skew when the frames can be
+// queued, such as the sealed packets.
+func NewReplayWindow(maxAge, skew time.Duration) *ReplayWindow {
+	return &ReplayWindow{
+		maxAge:  maxAge,
+		skew:    skew,
+		max:     maxReplayIDs,
+		senders: make(map[string]*replaySender),
+	}
+}
+
+// Check returns an error if the frame is replayed or stale, otherwise the
+// frame is remembered.
+func (w *ReplayWindow) Check(frame *share.Frame) error {
+	return w.CheckMessage(frame.From, frame.Time, frame.MessageID)
+}
+
+// CheckMessage is the same as Check, for a message from the sender, sent
+// at the time (unix nanoseconds), see share.Replay.
+func (w *ReplayWindow) CheckMessage(from string, sentNano int64, messageID string) error {
+	if messageID == "" {
+		return errors.New("frame has no message id")
+	}
+	now := time.Now()
+	sent := time.Unix(0, sentNano)
+	if sent.Before(now.Add(-w.maxAge)) {
+		return fmt.Errorf("stale frame sent %v ago", now.Sub(sent).Round(time.Second))
+	}
+	if sent.After(now.Add(w.skew)) {
+		return fmt.Errorf("frame sent %v in the future, please check the clock", sent.Sub(now).Round(time.Second))
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.purge(now)
+	s := w.senders[from]
+	if s == nil {
+		s = &replaySender{seen: make(map[string]time.Time)}
+		w.senders[from] = s
+	}
+	if _, ok := s.seen[messageID]; ok {
+		return fmt.Errorf("replayed frame %s", messageID)
+	}
+	if !sent.After(s.floor) {
+		return errors.New("too many frames from the sender in the replay window")
+	}
+	for len(s.order) >= w.max {
+		old := heap.Pop(&s.order).(replayID)
+		delete(s.seen, old.id)
+		if old.sent.After(s.floor) {
+			s.floor = old.sent
+		}
+	}
+	s.seen[messageID] = sent
+	heap.Push(&s.order, replayID{id: messageID, sent: sent})
+	return nil
+}
+
+// purge forgets the ids out of the window.
+func (w *ReplayWindow) purge(now time.Time) {
+	expire := now.Add(-w.maxAge)
+	for from, s := range w.senders {
+		for len(s.order) > 0 && s.order[0].sent.Before(expire) {
+			old := heap.Pop(&s.order).(replayID)
+			delete(s.seen, old.id)
+		}
+		if len(s.order) == 0 && s.floor.Before(expire) {
+			delete(w.senders, from)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package transfer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/dustin/go-humanize"
+	"github.com/fioncat/wshare/config"
+	"github.com/fioncat/wshare/pkg/osutil"
+	"github.com/fioncat/wshare/share"
+)
+
+// frameOverhead is the extra space reserved for the frame header and the
+// encryption, on top of the chunk size.
+const frameOverhead = 64 * 1024
+
+// ChunkSize returns the configured chunk size in bytes.
+func ChunkSize() (int, error) {
+	str := config.Get().Transfer.ChunkSize
+	size, err := humanize.ParseBytes(str)
+	if err != nil {
+		return 0, fmt.Errorf("invalid chunk size %q: %v", str, err)
+	}
+	if size == 0 {
+		return 0, errors.New("chunk size cannot be zero")
+	}
+	return int(size), nil
+}
+
+// CompressThreshold returns the configured compress threshold in bytes,
+// 0 means compressing is disabled.
+func CompressThreshold() (int, error) {
+	str := config.Get().Transfer.CompressThreshold
+	size, err := humanize.ParseBytes(str)
+	if err != nil {
+		return 0, fmt.Errorf("invalid compress threshold %q: %v", str, err)
+	}
+	return int(size), nil
+}
+
+// MaxSize returns the configured max size of a payload received.
+func MaxSize() (int64, error) {
+	str := config.Get().Transfer.MaxSize
+	size, err := humanize.ParseBytes(str)
+	if err != nil {
+		return 0, fmt.Errorf("invalid max size %q: %v", str, err)
+	}
+	if size == 0 {
+		return 0, errors.New("max size cannot be zero")
+	}
+	return int64(size), nil
+}
+
+// MaxFrameSize returns the max size of an encoded frame for a chunk size.
+func MaxFrameSize(chunkSize int) int64 {
+	return int64(chunkSize)*2 + frameOverhead
+}
+
+func NewID() string {
+	buf := make([]byte, 16)
+	_, err := io.ReadFull(rand.Reader, buf)
+	if err != nil {
+		// This should not be triggered in normal case
+		panic("internal: failed to generate random id: " + err.Error())
+	}
+	return hex.EncodeToString(buf)
+}
+
+// Split splits a payload into frames. The frames share memory with the
+// payload.
+func Split(payload []byte, chunkSize int) []*share.Frame {
+	id := NewID()
+	hash := osutil.Sum(payload)
+	size := int64(len(payload))
+
+	total := (len(payload) + chunkSize - 1) / chunkSize
+	if total == 0 {
+		total = 1
+	}
+	frames := make([]*share.Frame, total)
+	for i := range frames {
+		start := i * chunkSize
+		end := start + chunkSize
+		if end > len(payload) {
+			end = len(payload)
+		}
+		frames[i] = &share.Frame{
+			Kind:   share.FrameChunk,
+			ID:     id,
+			Index:  i,
+			Total:  total,
+			Offset: int64(start),
+			Size:   size,
+			Hash:   hash,
+			Data:   payload[start:end],
+		}
+	}
+	return frames
+}
@@ -0,0 +1,233 @@
+package transfer
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fioncat/wshare/share"
+)
+
+func TestTransfer(t *testing.T) {
+	payload := make([]byte, 1000)
+	rand.Read(payload)
+
+	frames := Split(payload, 64)
+	if len(frames) != 16 {
+		t.Fatalf("unexpect frame count %d", len(frames))
+	}
+
+	r := NewReceiver(64, 1<<20)
+	// Frames can arrive out of order and more than once.
+	rand.Shuffle(len(frames), func(i, j int) {
+		frames[i], frames[j] = frames[j], frames[i]
+	})
+	frames = append(frames, frames[0])
+
+	var result io.ReadCloser
+	for i, frame := range frames {
+		rd, err := r.Add(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rd != nil {
+			if i != len(frames)-2 {
+				t.Fatalf("unexpect complete at frame %d", i)
+			}
+			result = rd
+		}
+	}
+	if result == nil {
+		t.Fatal("expect transfer complete")
+	}
+	defer result.Close()
+
+	data, err := io.ReadAll(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, payload) {
+		t.Fatal("unexpect payload")
+	}
+}
+
+func TestReceiverLimits(t *testing.T) {
+	// The incomplete transfers are kept in temp files.
+	t.Setenv("TMPDIR", t.TempDir())
+	r := NewReceiver(100, 1000)
+	for _, f := range []*share.Frame{
+		// Too large.
+		{Kind: share.FrameChunk, ID: "a", Total: 11, Size: 1001, Data: make([]byte, 100)},
+		// Total does not match the size.
+		{Kind: share.FrameChunk, ID: "b", Total: 1000, Size: 1000, Data: make([]byte, 100)},
+		// Offset does not match the index.
+		{Kind: share.FrameChunk, ID: "c", Index: 1, Total: 10, Offset: 50, Size: 1000, Data: make([]byte, 100)},
+		// Data does not match the chunk size.
+		{Kind: share.FrameChunk, ID: "d", Total: 10, Size: 1000, Data: make([]byte, 10)},
+	} {
+		_, err := r.Add(f)
+		if err == nil {
+			t.Fatalf("expect error for frame %s", f.ID)
+		}
+	}
+
+	for i := 0; i < maxInboundPerSender+1; i++ {
+		frames := Split(make([]byte, 200), 100)
+		frames[0].From = "a"
+		_, err := r.Add(frames[0])
+		if i < maxInboundPerSender && err != nil {
+			t.Fatal(err)
+		}
+		if i == maxInboundPerSender && err == nil {
+			t.Fatal("expect error for too many transfers")
+		}
+	}
+	frames := Split(make([]byte, 200), 100)
+	frames[0].From = "b"
+	_, err := r.Add(frames[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResume(t *testing.T) {
+	payload := make([]byte, 1000)
+	rand.Read(payload)
+	frames := Split(payload, 100)
+
+	outbox := NewOutbox()
+	outbox.Add(frames)
+	for _, frame := range frames[:4] {
+		outbox.Sent(frame)
+	}
+	unsent := outbox.Unsent()[frames[0].ID]
+	if len(unsent) != 6 || unsent[0].Index != 4 {
+		t.Fatalf("unexpect unsent frames: %d", len(unsent))
+	}
+
+	r := NewReceiver(100, 1<<20)
+	if r.Resume(outbox.Query(frames[0].ID)) != nil {
+		t.Fatal("expect no resume for unknown transfer")
+	}
+	// The receiver lost frame 1 and 3.
+	for _, idx := range []int{0, 2, 4, 5} {
+		_, err := r.Add(frames[idx])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	resume := r.Resume(outbox.Query(frames[0].ID))
+	missing := outbox.Missing(resume)
+	var idxs []int
+	for _, frame := range missing {
+		idxs = append(idxs, frame.Index)
+	}
+	if !reflect.DeepEqual(idxs, []int{1, 3, 6, 7, 8, 9}) {
+		t.Fatalf("unexpect missing frames: %v", idxs)
+	}
+
+	var result io.ReadCloser
+	for _, frame := range missing {
+		rd, err := r.Add(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rd != nil {
+			result = rd
+		}
+	}
+	if result == nil {
+		t.Fatal("expect transfer complete")
+	}
+	result.Close()
+	if r.Resume(outbox.Query(frames[0].ID)) != nil {
+		t.Fatal("expect no resume for completed transfer")
+	}
+}
+
+func TestOutboxReceipts(t *testing.T) {
+	frames := Split(make([]byte, 1000), 100)
+	id := frames[0].ID
+	outbox := NewOutbox()
+	outbox.Add(frames)
+	resume := &share.Frame{Kind: share.FrameResume, ID: id}
+
+	// Receipts before the ack are ignored.
+	outbox.Receipt(&share.Frame{Kind: share.FrameReceipt, ID: id, From: "a"})
+	outbox.Acked(&share.Frame{Kind: share.FrameAck, ID: id, To: []string{"a", "b"}})
+	outbox.Receipt(&share.Frame{Kind: share.FrameReceipt, ID: id, From: "a"})
+	if len(outbox.Missing(resume)) != len(frames) {
+		t.Fatal("expect transfer to be kept until all receipts")
+	}
+	outbox.Receipt(&share.Frame{Kind: share.FrameReceipt, ID: id, From: "b"})
+	if outbox.Missing(resume) != nil {
+		t.Fatal("expect transfer to be dropped after all receipts")
+	}
+}
+
+func TestOutboxMaxBytes(t *testing.T) {
+	outbox := NewOutbox()
+	outbox.max = 500
+	frames := Split(make([]byte, 1000), 100)
+	resume := &share.Frame{Kind: share.FrameResume, ID: frames[0].ID}
+	outbox.Add(frames)
+	for _, f := range frames[:len(frames)-1] {
+		outbox.Sent(f)
+	}
+	if len(outbox.Missing(resume)) != len(frames) {
+		t.Fatal("expect transfer being sent to be kept")
+	}
+	outbox.Sent(frames[len(frames)-1])
+	if outbox.Missing(resume) != nil {
+		t.Fatal("expect transfer larger than the limit to be dropped after sent")
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	w := NewReplayWindow(time.Minute, time.Minute)
+	frame := &share.Frame{Time: time.Now().UnixNano(), MessageID: NewID()}
+	err := w.Check(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Check(frame) == nil {
+		t.Fatal("expect replayed frame to be rejected")
+	}
+
+	for _, d := range []time.Duration{-time.Hour, time.Hour} {
+		frame := &share.Frame{Time: time.Now().Add(d).UnixNano(), MessageID: NewID()}
+		if w.Check(frame) == nil {
+			t.Fatalf("expect frame out of skew (%v) to be rejected", d)
+		}
+	}
+}
+
+func TestReplayWindowFull(t *testing.T) {
+	w := NewReplayWindow(time.Minute, time.Minute)
+	w.max = 2
+	now := time.Now()
+	var frames []*share.Frame
+	for i := 0; i < 3; i++ {
+		frame := &share.Frame{From: "a", Time: now.Add(time.Duration(i) * time.Second).UnixNano(), MessageID: NewID()}
+		err := w.Check(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, frame)
+	}
+	// The oldest id is forgotten, but its replay is still rejected.
+	if w.Check(frames[0]) == nil {
+		t.Fatal("expect replay of the forgotten frame to be rejected")
+	}
+	err := w.Check(&share.Frame{From: "b", Time: now.UnixNano(), MessageID: NewID()})
+	if err != nil {
+		t.Fatalf("expect other senders to be accepted: %v", err)
+	}
+	err = w.Check(&share.Frame{From: "a", Time: now.Add(3 * time.Second).UnixNano(), MessageID: NewID()})
+	if err != nil {
+		t.Fatalf("expect newer frame to be accepted: %v", err)
+	}
+}
@@ -0,0 +1,237 @@
+package share
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/fioncat/wshare/pkg/crypto"
+	"github.com/fioncat/wshare/pkg/wire"
+)
+
+// The encoding of packets and frames, see docs/protocol.md. The tags must
+// not be changed or reused, new fields should use new tags.
+
+// ProtocolVersion is the version of the wire format, it is written in the
+// header of each message by crypto.Key.
+const ProtocolVersion = crypto.Version
+
+// The fields of a payload (see Packet.Encode).
+const (
+	packetType     = 1
+	packetMetadata = 2
+	packetData     = 3
+	packetTo       = 4
+
+	// packetSealed holds an end-to-end encrypted packet, see crypto.Sealed.
+	packetSealed = 15
+)
+
+// The fields of a frame.
+const (
+	frameKind      = 1
+	frameID        = 2
+	frameIndex     = 3
+	frameTotal     = 4
+	frameOffset    = 5
+	frameSize      = 6
+	frameHash      = 7
+	frameData      = 8
+	frameReceived  = 9
+	frameTo        = 10
+	frameTime      = 11
+	frameMessageID = 12
+	frameError     = 13
+	frameFrom      = 14
+	frameSent      = 15
+	frameHop       = 16
+)
+
+// The fields of a hop in a frame.
+const (
+	hopName = 1
+	hopTime = 2
+)
+
+// maxPayloadField limits a field when decoding payloads.
+const maxPayloadField = math.MaxInt32
+
+func (p *Packet) marshal() []byte {
+	var e wire.Encoder
+	e.String(packetType, p.Type)
+	e.Raw(packetMetadata, p.Metadata)
+	e.Raw(packetData, p.Data)
+	e.Strings(packetTo, p.To)
+	return e.Bytes()
+}
+
+// decodePayload decodes a payload, if the payload is sealed, the packet is
+// nil.
+func decodePayload(r io.Reader) (*Packet, *crypto.Sealed, error) {
+	var p Packet
+	var sealed *crypto.Sealed
+	err := wire.NewDecoder(r, maxPayloadField).Decode(func(tag uint64, value []byte) error {
+		switch tag {
+		case packetType:
+			p.Type = string(value)
+		case packetMetadata:
+			p.Metadata = value
+		case packetData:
+			p.Data = value
+		case packetTo:
+			p.To = append(p.To, string(value))
+		case packetSealed:
+			sealed = new(crypto.Sealed)
+			return sealed.UnmarshalBinary(value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if sealed != nil {
+		return nil, sealed, nil
+	}
+	return &p, nil, nil
+}
+
+func (f *Frame) marshal() []byte {
+	var e wire.Encoder
+	e.String(frameKind, string(f.Kind))
+	e.String(frameID, f.ID)
+	e.Uint(frameIndex, uint64(f.Index))
+	e.Uint(frameTotal, uint64(f.Total))
+	e.Int(frameOffset, f.Offset)
+	e.Int(frameSize, f.Size)
+	e.String(frameHash, f.Hash)
+	e.Raw(frameData, f.Data)
+	for _, index := range f.Received {
+		// Not e.Uint, which omits zero.
+		e.Raw(frameReceived, binary.AppendUvarint(nil, uint64(index)))
+	}
+	e.Strings(frameTo, f.To)
+	e.Int(frameTime, f.Time)
+	e.String(frameMessageID, f.MessageID)
+	e.String(frameError, f.Error)
+	e.String(frameFrom, f.From)
+	e.Int(frameSent, f.Sent)
+	for _, hop := range f.Hops {
+		var he wire.Encoder
+		he.String(hopName, hop.Name)
+		he.Int(hopTime, hop.Time)
+		e.Raw(frameHop, he.Bytes())
+	}
+	return e.Bytes()
+}
+
+func unmarshalFrame(data []byte) (*Frame, error) {
+	var f Frame
+	err := wire.Unmarshal(data, func(tag uint64, value []byte) error {
+		var err error
+		switch tag {
+		case frameKind:
+			f.Kind = FrameKind(value)
+		case frameID:
+			f.ID = string(value)
+		case frameIndex:
+			f.Index, err = decodeInt(value)
+		case frameTotal:
+			f.Total, err = decodeInt(value)
+		case frameOffset:
+			f.Offset, err = wire.Int(value)
+		case frameSize:
+			f.Size, err = wire.Int(value)
+		case frameHash:
+			f.Hash = string(value)
+		case frameData:
+			f.Data = value
+		case frameReceived:
+			var index int
+			index, err = decodeInt(value)
+			f.Received = append(f.Received, index)
+		case frameTo:
+			f.To = append(f.To, string(value))
+		case frameTime:
+			f.Time, err = wire.Int(value)
+		case frameMessageID:
+			f.MessageID = string(value)
+		case frameError:
+			f.Error = string(value)
+		case frameFrom:
+			f.From = string(value)
+		case frameSent:
+			f.Sent, err = wire.Int(value)
+		case frameHop:
+			var hop Hop
+			err = wire.Unmarshal(value, func(tag uint64, value []byte) error {
+				var err error
+				switch tag {
+				case hopName:
+					hop.Name = string(value)
+				case hopTime:
+					hop.Time, err = wire.Int(value)
+				}
+				return err
+			})
+			f.Hops = append(f.Hops, hop)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func decodeInt(value []byte) (int, error) {
+	v, err := wire.Uint(value)
+	if err != nil {
+		return 0, err
+	}
+	if v > math.MaxInt32 {
+		return 0, errors.New("int overflow")
+	}
+	return int(v), nil
+}
+
+// SupportedVersions is the protocol versions this build can speak.
+var SupportedVersions = []int{ProtocolVersion}
+
+// FormatVersions formats versions for HeaderProtocol.
+func FormatVersions(versions []int) string {
+	strs := make([]string, len(versions))
+	for i, version := range versions {
+		strs[i] = strconv.Itoa(version)
+	}
+	return strings.Join(strs, ",")
+}
+
+// NegotiateVersion returns the highest version in SupportedVersions that
+// is also in header, the versions supported by the peer (see
+// HeaderProtocol).
+func NegotiateVersion(header string) (int, error) {
+	if header == "" {
+		return 0, errors.New("the peer does not negotiate protocol version, it is too old, please upgrade it")
+	}
+	version := 0
+	for _, str := range strings.Split(header, ",") {
+		v, err := strconv.Atoi(strings.TrimSpace(str))
+		if err != nil {
+			return 0, fmt.Errorf("invalid protocol versions %q", header)
+		}
+		for _, supported := range SupportedVersions {
+			if v == supported && v > version {
+				version = v
+			}
+		}
+	}
+	if version == 0 {
+		return 0, fmt.Errorf("no common protocol version, the peer supports %s, we support %s, please upgrade the older one",
+			header, FormatVersions(SupportedVersions))
+	}
+	return version, nil
+}